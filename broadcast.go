@@ -28,6 +28,10 @@ func NewBroadcaster(protocol ProtocolState, fetcher func(func(SessionAble))) *Br
 // Broadcast to sessions. The message only encoded once
 // so the performance is better than send message one by one.
 func (b *Broadcaster) Broadcast(message Message, timeout time.Duration) ([]BroadcastWork, error) {
+	return b.broadcast(message, timeout, b.fetcher)
+}
+
+func (b *Broadcaster) broadcast(message Message, timeout time.Duration, fetcher func(func(SessionAble))) ([]BroadcastWork, error) {
 	buffer := NewOutBuffer()
 
 	if err := b.protocol.WriteToBuffer(&buffer, message); err != nil {
@@ -35,7 +39,7 @@ func (b *Broadcaster) Broadcast(message Message, timeout time.Duration) ([]Broad
 		return nil, err
 	}
 	works := make([]BroadcastWork, 0, 10)
-	b.fetcher(func(session SessionAble) {
+	fetcher(func(session SessionAble) {
 		// buffer.broadcastUse()
 		works = append(works, BroadcastWork{
 			session,
@@ -49,22 +53,39 @@ func (b *Broadcaster) Broadcast(message Message, timeout time.Duration) ([]Broad
 // Normally used for broadcast classify purpose.
 type Channel struct {
 	mutex       sync.RWMutex
-	sessions    map[uint64]channelSession
+	sessions    map[uint64]*channelSession
 	broadcaster *Broadcaster
 
+	// About cross-process broadcast
+	busMutex  sync.RWMutex
+	bus       ChannelBus
+	busName   string
+	busCancel func()
+
 	// channel state
 	State interface{}
 }
 
+// The member of a channel. Role, Team and Muted are not used by the channel itself,
+// they are kept for application logic like moderation.
+type ChannelMember struct {
+	Session SessionAble
+	Meta    interface{}
+	Role    string
+	Team    string
+	Muted   bool
+}
+
 type channelSession struct {
-	SessionAble
+	ChannelMember
 	KickCallback func()
+	closeHandle  CloseCallbackHandle
 }
 
 // Create a channel instance.
 func NewChannel(protocol Protocol, side ProtocolSide) *Channel {
 	channel := &Channel{
-		sessions: make(map[uint64]channelSession),
+		sessions: make(map[uint64]*channelSession),
 	}
 	protocolState, _ := protocol.New(channel, side)
 	channel.broadcaster = NewBroadcaster(protocolState, channel.Fetch)
@@ -73,8 +94,13 @@ func NewChannel(protocol Protocol, side ProtocolSide) *Channel {
 
 // Broadcast to channel. The message only encoded once
 // so the performance is better than send message one by one.
+// When the channel bound to a bus, the message will also published to other processes.
 func (channel *Channel) Broadcast(message Message, timeout time.Duration) ([]BroadcastWork, error) {
-	return channel.broadcaster.Broadcast(message, timeout)
+	works, err := channel.broadcaster.Broadcast(message, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return works, channel.publish(message)
 }
 
 // How mush sessions in this channel.
@@ -86,14 +112,36 @@ func (channel *Channel) Len() int {
 }
 
 // Join the channel. The kickCallback will called when the session kick out from the channel.
+// Join again will replace the kickCallback and reset the member state. A closed session will not join.
 func (channel *Channel) Join(session SessionAble, kickCallback func()) {
+	channel.join(session, nil, kickCallback)
+}
+
+// Join the channel with member metadata. The kickCallback will called when the session kick out from the channel.
+func (channel *Channel) JoinWithMeta(session SessionAble, meta interface{}, kickCallback func()) {
+	channel.join(session, meta, kickCallback)
+}
+
+func (channel *Channel) join(session SessionAble, meta interface{}, kickCallback func()) {
 	channel.mutex.Lock()
 	defer channel.mutex.Unlock()
 
-	session.AddCloseCallback(channel, func() {
-		channel.Exit(session)
+	if old, exists := channel.sessions[session.Id()]; exists {
+		old.Session.RemoveCloseCallback(old.closeHandle)
+	}
+
+	member := &channelSession{
+		ChannelMember: ChannelMember{Session: session, Meta: meta},
+		KickCallback:  kickCallback,
+	}
+	member.closeHandle = session.AddCloseCallback(func() {
+		channel.remove(member)
 	})
-	channel.sessions[session.Id()] = channelSession{session, kickCallback}
+	if session.IsClosed() {
+		delete(channel.sessions, session.Id())
+		return
+	}
+	channel.sessions[session.Id()] = member
 }
 
 // Exit the channel.
@@ -101,8 +149,10 @@ func (channel *Channel) Exit(session SessionAble) {
 	channel.mutex.Lock()
 	defer channel.mutex.Unlock()
 
-	session.RemoveCloseCallback(channel)
-	delete(channel.sessions, session.Id())
+	if member, exists := channel.sessions[session.Id()]; exists {
+		member.Session.RemoveCloseCallback(member.closeHandle)
+		delete(channel.sessions, session.Id())
+	}
 }
 
 // Kick out a session from the channel.
@@ -111,6 +161,7 @@ func (channel *Channel) Kick(sessionId uint64) {
 	defer channel.mutex.Unlock()
 
 	if session, exists := channel.sessions[sessionId]; exists {
+		session.Session.RemoveCloseCallback(session.closeHandle)
 		delete(channel.sessions, sessionId)
 		if session.KickCallback != nil {
 			session.KickCallback()
@@ -118,12 +169,60 @@ func (channel *Channel) Kick(sessionId uint64) {
 	}
 }
 
+// Remove a closed session. Nothing happen when the session joined again after the callback added.
+func (channel *Channel) remove(member *channelSession) {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	if channel.sessions[member.Session.Id()] == member {
+		delete(channel.sessions, member.Session.Id())
+	}
+}
+
 // Fetch the sessions. NOTE: Invoke Kick() or Exit() in fetch callback will dead lock.
 func (channel *Channel) Fetch(callback func(SessionAble)) {
 	channel.mutex.RLock()
 	defer channel.mutex.RUnlock()
 
 	for _, sesssion := range channel.sessions {
-		callback(sesssion.SessionAble)
+		callback(sesssion.Session)
+	}
+}
+
+// Get a member by session id.
+func (channel *Channel) Member(sessionId uint64) (ChannelMember, bool) {
+	channel.mutex.RLock()
+	defer channel.mutex.RUnlock()
+
+	if member, exists := channel.sessions[sessionId]; exists {
+		return member.ChannelMember, true
+	}
+	return ChannelMember{}, false
+}
+
+// Fetch the members with metadata. NOTE: Invoke Kick(), Exit() or UpdateMember() in fetch callback will dead lock.
+func (channel *Channel) FetchMembers(callback func(ChannelMember)) {
+	channel.mutex.RLock()
+	defer channel.mutex.RUnlock()
+
+	for _, member := range channel.sessions {
+		callback(member.ChannelMember)
+	}
+}
+
+// Update the state of a member. Changing the Session field has no effect.
+// Returns false when the session is not in this channel.
+func (channel *Channel) UpdateMember(sessionId uint64, update func(*ChannelMember)) bool {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	member, exists := channel.sessions[sessionId]
+	if !exists {
+		return false
 	}
+	state := member.ChannelMember
+	update(&state)
+	state.Session = member.Session
+	member.ChannelMember = state
+	return true
 }
@@ -0,0 +1,388 @@
+package link
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Errors
+var (
+	BadBusFrameError = errors.New("Bad bus frame")
+)
+
+var (
+	DefaultBusBroadcastTimeout = time.Second // Default timeout for broadcast messages received from bus.
+)
+
+// The channel bus. Used to deliver channel broadcasts to other processes.
+// The publisher never receives the messages published by itself.
+type ChannelBus interface {
+	// Publish a message body to the named channel in other processes.
+	Publish(name string, data []byte) error
+
+	// Subscribe the named channel. The handler will called when other processes publish to it.
+	// The data is only valid in the handler. Invoke the returned function to unsubscribe.
+	Subscribe(name string, handler func(data []byte)) (unsubscribe func(), err error)
+}
+
+// Bind the channel to a bus with a name. Then the broadcast messages will
+// publish to the channels with the same name in other processes, and the
+// messages published by other processes will broadcast to this channel.
+func (channel *Channel) BindBus(name string, bus ChannelBus) error {
+	unsubscribe, err := bus.Subscribe(name, func(data []byte) {
+		channel.broadcaster.Broadcast(BytesMessage(data), DefaultBusBroadcastTimeout)
+	})
+	if err != nil {
+		return err
+	}
+
+	channel.busMutex.Lock()
+	oldCancel := channel.busCancel
+	channel.bus = bus
+	channel.busName = name
+	channel.busCancel = unsubscribe
+	channel.busMutex.Unlock()
+
+	if oldCancel != nil {
+		oldCancel()
+	}
+	return nil
+}
+
+// Unbind the channel from bus.
+func (channel *Channel) UnbindBus() {
+	channel.busMutex.Lock()
+	cancel := channel.busCancel
+	channel.bus = nil
+	channel.busName = ""
+	channel.busCancel = nil
+	channel.busMutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (channel *Channel) publish(message Message) error {
+	return publishAll([]*Channel{channel}, message)
+}
+
+// Publish a message to the bound channels. The message only encoded once.
+// Returns the first error and keep publishing to the others.
+func publishAll(channels []*Channel, message Message) error {
+	var data []byte
+	var err error
+	for _, channel := range channels {
+		channel.busMutex.RLock()
+		bus, name := channel.bus, channel.busName
+		channel.busMutex.RUnlock()
+
+		if bus == nil {
+			continue
+		}
+		if data == nil {
+			data = make([]byte, message.Size())
+			n, e := message.MarshalTo(data)
+			if e != nil {
+				return e
+			}
+			data = data[:n]
+		}
+		if e := bus.Publish(name, data); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+const (
+	busSubscribe   = 1
+	busUnsubscribe = 2
+	busPublish     = 3
+)
+
+// {op:uint8}{name_len:uvarint}{name}{data}
+type busFrame struct {
+	op   uint8
+	name string
+	data []byte
+}
+
+func (frame busFrame) Size() int {
+	return 1 + UvarintSize(uint64(len(frame.name))) + len(frame.name) + len(frame.data)
+}
+
+func (frame busFrame) MarshalTo(buffer []byte) (n int, err error) {
+	if len(buffer) < frame.Size() {
+		return 0, BufferSizeNotEnough
+	}
+	buffer[0] = frame.op
+	n = 1 + binary.PutUvarint(buffer[1:], uint64(len(frame.name)))
+	n += copy(buffer[n:], frame.name)
+	n += copy(buffer[n:], frame.data)
+	return
+}
+
+func decodeBusFrame(msg *InBuffer) (frame busFrame, err error) {
+	if len(msg.Data) < 2 {
+		return frame, BadBusFrameError
+	}
+	frame.op = msg.ReadUint8()
+	nameLen, n := binary.Uvarint(msg.Data[msg.ReadPos:])
+	if n <= 0 || nameLen > uint64(len(msg.Data)-msg.ReadPos-n) {
+		return frame, BadBusFrameError
+	}
+	msg.ReadPos += n
+	frame.name = msg.ReadString(int(nameLen))
+	frame.data = msg.Data[msg.ReadPos:]
+	return
+}
+
+// The bus hub. Nodes in different processes connect to the hub,
+// the hub forward published messages to the nodes subscribed the channel.
+type BusHub struct {
+	server      *Server
+	broadcaster *Broadcaster
+
+	mutex       sync.RWMutex
+	subscribers map[string]map[uint64]SessionAble
+	nodes       map[uint64]map[string]struct{}
+
+	SendTimeout time.Duration // Timeout for forward messages to nodes.
+}
+
+// The easy way to setup a bus hub.
+func ListenBusHub(network, address string) (*BusHub, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewBusHub(listener), nil
+}
+
+// Create a bus hub.
+func NewBusHub(listener net.Listener) *BusHub {
+	hub := &BusHub{
+		server:      NewServer(listener, DefaultProtocol),
+		subscribers: make(map[string]map[uint64]SessionAble),
+		nodes:       make(map[uint64]map[string]struct{}),
+		SendTimeout: DefaultBusBroadcastTimeout,
+	}
+	protocolState, _ := DefaultProtocol.New(hub, SERVER_SIDE)
+	hub.broadcaster = NewBroadcaster(protocolState, nil)
+	return hub
+}
+
+// Get hub server.
+func (hub *BusHub) Server() *Server {
+	return hub.server
+}
+
+// Loop and accept nodes.
+func (hub *BusHub) Serve() error {
+	return hub.server.Serve(func(session SessionAble) {
+		session.AddCloseCallback(func() {
+			hub.unsubscribeAll(session)
+		})
+		session.Process(func(msg *InBuffer) error {
+			frame, err := decodeBusFrame(msg)
+			if err != nil {
+				return err
+			}
+			switch frame.op {
+			case busSubscribe:
+				hub.subscribe(session, frame.name)
+			case busUnsubscribe:
+				hub.unsubscribe(session, frame.name)
+			case busPublish:
+				hub.forward(session, frame.name, msg.Data)
+			}
+			return nil
+		})
+	})
+}
+
+// Stop the hub.
+func (hub *BusHub) Stop() bool {
+	return hub.server.Stop()
+}
+
+// How mush nodes subscribed the named channel.
+func (hub *BusHub) SubscriberCount(name string) int {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	return len(hub.subscribers[name])
+}
+
+func (hub *BusHub) subscribe(session SessionAble, name string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if session.IsClosed() {
+		return
+	}
+
+	subscribers, exists := hub.subscribers[name]
+	if !exists {
+		subscribers = make(map[uint64]SessionAble)
+		hub.subscribers[name] = subscribers
+	}
+	subscribers[session.Id()] = session
+
+	names, exists := hub.nodes[session.Id()]
+	if !exists {
+		names = make(map[string]struct{})
+		hub.nodes[session.Id()] = names
+	}
+	names[name] = struct{}{}
+}
+
+func (hub *BusHub) unsubscribe(session SessionAble, name string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.remove(session, name)
+}
+
+func (hub *BusHub) unsubscribeAll(session SessionAble) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for name := range hub.nodes[session.Id()] {
+		hub.remove(session, name)
+	}
+	delete(hub.nodes, session.Id())
+}
+
+// Must hold the mutex.
+func (hub *BusHub) remove(session SessionAble, name string) {
+	if subscribers, exists := hub.subscribers[name]; exists {
+		delete(subscribers, session.Id())
+		if len(subscribers) == 0 {
+			delete(hub.subscribers, name)
+		}
+	}
+	if names, exists := hub.nodes[session.Id()]; exists {
+		delete(names, name)
+	}
+}
+
+// Forward a publish frame to other subscribers without decode it.
+func (hub *BusHub) forward(publisher SessionAble, name string, frame []byte) {
+	hub.broadcaster.broadcast(BytesMessage(frame), hub.SendTimeout, func(callback func(SessionAble)) {
+		hub.mutex.RLock()
+		defer hub.mutex.RUnlock()
+
+		for id, session := range hub.subscribers[name] {
+			if id != publisher.Id() {
+				callback(session)
+			}
+		}
+	})
+}
+
+// The bus node. Connect to a bus hub and implement the ChannelBus interface.
+type BusNode struct {
+	session  *Session
+	mutex    sync.Mutex
+	lastId   uint64
+	handlers map[string]map[uint64]func([]byte)
+}
+
+// The easy way to connect a bus hub.
+func DialBus(network, address string) (*BusNode, error) {
+	session, err := Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewBusNode(session), nil
+}
+
+// Create a bus node on a session connected to the hub.
+func NewBusNode(session *Session) *BusNode {
+	node := &BusNode{
+		session:  session,
+		handlers: make(map[string]map[uint64]func([]byte)),
+	}
+	go session.Process(func(msg *InBuffer) error {
+		frame, err := decodeBusFrame(msg)
+		if err != nil || frame.op != busPublish {
+			return err
+		}
+		node.dispatch(frame.name, frame.data)
+		return nil
+	})
+	return node
+}
+
+// Get node session.
+func (node *BusNode) Session() *Session {
+	return node.session
+}
+
+// Close the node.
+func (node *BusNode) Close() {
+	node.session.Close()
+}
+
+// Publish a message body to the named channel in other processes.
+func (node *BusNode) Publish(name string, data []byte) error {
+	return node.session.Send(busFrame{busPublish, name, data}, time.Now())
+}
+
+// Subscribe the named channel.
+func (node *BusNode) Subscribe(name string, handler func(data []byte)) (func(), error) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	handlers, exists := node.handlers[name]
+	if !exists {
+		if err := node.session.Send(busFrame{busSubscribe, name, nil}, time.Now()); err != nil {
+			return nil, err
+		}
+		handlers = make(map[uint64]func([]byte))
+		node.handlers[name] = handlers
+	}
+	node.lastId++
+	id := node.lastId
+	handlers[id] = handler
+
+	return func() {
+		node.unsubscribe(name, id)
+	}, nil
+}
+
+func (node *BusNode) unsubscribe(name string, id uint64) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	handlers, exists := node.handlers[name]
+	if !exists {
+		return
+	}
+	if _, exists := handlers[id]; !exists {
+		return
+	}
+	delete(handlers, id)
+	if len(handlers) == 0 {
+		delete(node.handlers, name)
+		node.session.Send(busFrame{busUnsubscribe, name, nil}, time.Now())
+	}
+}
+
+func (node *BusNode) dispatch(name string, data []byte) {
+	node.mutex.Lock()
+	handlers := make([]func([]byte), 0, len(node.handlers[name]))
+	for _, handler := range node.handlers[name] {
+		handlers = append(handlers, handler)
+	}
+	node.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(data)
+	}
+}
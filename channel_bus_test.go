@@ -0,0 +1,97 @@
+package link
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type busGateway struct {
+	server  *Server
+	node    *BusNode
+	manager *ChannelManager
+}
+
+func newBusGateway(t *testing.T, hubAddr string) *busGateway {
+	server, err := Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	node, err := DialBus("tcp", hubAddr)
+	assert.Nil(t, err)
+
+	gateway := &busGateway{server, node, NewChannelManager(DefaultProtocol, SERVER_SIDE)}
+	assert.Nil(t, gateway.manager.SetBus(node))
+	go server.Serve(func(session SessionAble) {
+		if _, err := gateway.manager.Join("room", session, nil); err != nil {
+			session.Close()
+			return
+		}
+		session.Process(func(*InBuffer) error { return nil })
+	})
+	return gateway
+}
+
+func (gateway *busGateway) stop() {
+	gateway.server.Stop()
+	gateway.node.Close()
+}
+
+func waitUntil(t *testing.T, condition func() bool) {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("wait timeout")
+}
+
+func TestChannelBus(t *testing.T) {
+	hub, err := ListenBusHub("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go hub.Serve()
+	defer hub.Stop()
+
+	hubAddr := hub.Server().Listener().Addr().String()
+	gateways := []*busGateway{
+		newBusGateway(t, hubAddr),
+		newBusGateway(t, hubAddr),
+		newBusGateway(t, hubAddr),
+	}
+	clients := make([]*Session, len(gateways))
+	for i, gateway := range gateways {
+		defer gateway.stop()
+		clients[i], err = Dial("tcp", gateway.server.Listener().Addr().String())
+		assert.Nil(t, err)
+		defer clients[i].Close()
+	}
+	waitUntil(t, func() bool {
+		for _, gateway := range gateways {
+			if channel := gateway.manager.Get("room"); channel == nil || channel.Len() != 1 {
+				return false
+			}
+		}
+		return hub.SubscriberCount("room") == len(gateways)
+	})
+
+	_, err = gateways[0].manager.Get("room").Broadcast(String("hello"), time.Second)
+	assert.Nil(t, err)
+	for _, client := range clients {
+		data, err := client.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(data))
+	}
+
+	gateways[2].manager.Destroy("room")
+	waitUntil(t, func() bool {
+		return hub.SubscriberCount("room") == 2
+	})
+	gateways[2].node.Close()
+	_, err = gateways[1].manager.Get("room").Broadcast(String("world"), time.Second)
+	assert.Nil(t, err)
+	for _, client := range clients[:2] {
+		data, err := client.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, "world", string(data))
+	}
+}
@@ -0,0 +1,431 @@
+package link
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Errors
+var (
+	ChannelExistsError = errors.New("Channel already exists")
+)
+
+// The channel manager. Used to maintain a group of named channels and
+// the index of which channels each session belongs to.
+// Sessions joined through the manager are removed from all channels when closed.
+type ChannelManager struct {
+	mutex       sync.RWMutex
+	protocol    Protocol
+	side        ProtocolSide
+	channels    map[string]*Channel
+	memberships map[uint64]map[string]*Channel
+	hooked      map[uint64]struct{}
+	broadcaster *Broadcaster
+	bus         ChannelBus
+	setBusMutex sync.Mutex // serialize SetBus, the mutex is not held during bus I/O
+}
+
+// Create a channel manager. The protocol and side are used to create channels.
+func NewChannelManager(protocol Protocol, side ProtocolSide) *ChannelManager {
+	manager := &ChannelManager{
+		protocol:    protocol,
+		side:        side,
+		channels:    make(map[string]*Channel),
+		memberships: make(map[uint64]map[string]*Channel),
+		hooked:      make(map[uint64]struct{}),
+	}
+	protocolState, _ := protocol.New(manager, side)
+	manager.broadcaster = NewBroadcaster(protocolState, nil)
+	return manager
+}
+
+// Create a named channel. Returns ChannelExistsError when the name is used.
+func (manager *ChannelManager) Create(name string) (*Channel, error) {
+	for {
+		manager.mutex.RLock()
+		_, exists := manager.channels[name]
+		bus := manager.bus
+		manager.mutex.RUnlock()
+
+		if exists {
+			return nil, ChannelExistsError
+		}
+		channel, err := manager.newChannel(name, bus)
+		if err != nil {
+			return nil, err
+		}
+		if ok, exists := manager.insert(name, channel, bus); ok {
+			return channel, nil
+		} else if exists {
+			return nil, ChannelExistsError
+		}
+	}
+}
+
+// Get a named channel, create it when not exists.
+// Returns the error of binding the new channel to the bus.
+func (manager *ChannelManager) GetOrCreate(name string) (*Channel, error) {
+	for {
+		manager.mutex.RLock()
+		channel, exists := manager.channels[name]
+		bus := manager.bus
+		manager.mutex.RUnlock()
+
+		if exists {
+			return channel, nil
+		}
+		channel, err := manager.newChannel(name, bus)
+		if err != nil {
+			return nil, err
+		}
+		if ok, _ := manager.insert(name, channel, bus); ok {
+			return channel, nil
+		}
+	}
+}
+
+// Insert a new channel bound to the bus. Fails when the name is used or the bus changed,
+// the new channel is unbound then.
+func (manager *ChannelManager) insert(name string, channel *Channel, bus ChannelBus) (ok, exists bool) {
+	manager.mutex.Lock()
+	_, exists = manager.channels[name]
+	ok = !exists && manager.bus == bus
+	if ok {
+		manager.channels[name] = channel
+	}
+	manager.mutex.Unlock()
+
+	if !ok {
+		channel.UnbindBus()
+	}
+	return
+}
+
+// Set the bus for cross-process broadcast. The channels will bound to the bus with their names.
+// Nil bus means unbind all channels. When a channel failed to bind, the channels are bound back
+// to the old bus and the error is returned.
+func (manager *ChannelManager) SetBus(bus ChannelBus) error {
+	manager.setBusMutex.Lock()
+	defer manager.setBusMutex.Unlock()
+
+	manager.mutex.RLock()
+	oldBus := manager.bus
+	channels := make(map[string]*Channel, len(manager.channels))
+	for name, channel := range manager.channels {
+		channels[name] = channel
+	}
+	manager.mutex.RUnlock()
+
+	// bind without the mutex, the bus may block
+	bound := make(map[string]*Channel, len(channels))
+	for name, channel := range channels {
+		if err := bindBus(name, channel, bus); err != nil {
+			for name, channel := range bound {
+				bindBus(name, channel, oldBus)
+			}
+			return err
+		}
+		bound[name] = channel
+	}
+
+	// the channels created in the meantime are bound to the old bus,
+	// and the channels destroyed in the meantime may be bound again
+	manager.mutex.Lock()
+	manager.bus = bus
+	late := make(map[string]*Channel)
+	for name, channel := range manager.channels {
+		if channels[name] != channel {
+			late[name] = channel
+		}
+	}
+	var destroyed []*Channel
+	for name, channel := range channels {
+		if manager.channels[name] != channel {
+			destroyed = append(destroyed, channel)
+		}
+	}
+	manager.mutex.Unlock()
+
+	for _, channel := range destroyed {
+		channel.UnbindBus()
+	}
+	var err error
+	for name, channel := range late {
+		if e := bindBus(name, channel, bus); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func bindBus(name string, channel *Channel, bus ChannelBus) error {
+	if bus == nil {
+		channel.UnbindBus()
+		return nil
+	}
+	return channel.BindBus(name, bus)
+}
+
+// Get a named channel. Returns nil when not exists.
+func (manager *ChannelManager) Get(name string) *Channel {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	return manager.channels[name]
+}
+
+// Destroy a named channel. All sessions in the channel will exit it.
+func (manager *ChannelManager) Destroy(name string) {
+	manager.mutex.Lock()
+	channel, exists := manager.channels[name]
+	if exists {
+		delete(manager.channels, name)
+	}
+	manager.mutex.Unlock()
+
+	if !exists {
+		return
+	}
+	channel.UnbindBus()
+
+	var sessions []SessionAble
+	channel.Fetch(func(session SessionAble) {
+		sessions = append(sessions, session)
+	})
+	for _, session := range sessions {
+		manager.forget(session, name, channel)
+		channel.Exit(session)
+	}
+}
+
+// Join a named channel, create the channel when not exists.
+// The kickCallback will called when the session kick out from the channel.
+// Returns the error of binding the new channel to the bus.
+func (manager *ChannelManager) Join(name string, session SessionAble, kickCallback func()) (*Channel, error) {
+	for {
+		channel, err := manager.GetOrCreate(name)
+		if err != nil {
+			return nil, err
+		}
+
+		manager.mutex.Lock()
+		if manager.channels[name] != channel {
+			// destroyed before remembered
+			manager.mutex.Unlock()
+			continue
+		}
+		hook := manager.remember(session, name, channel)
+		manager.mutex.Unlock()
+
+		if hook {
+			session.AddCloseCallback(func() {
+				manager.unhook(session)
+			})
+			if session.IsClosed() {
+				manager.unhook(session)
+				return channel, nil
+			}
+		}
+
+		channel.Join(session, func() {
+			manager.forget(session, name, channel)
+			if kickCallback != nil {
+				kickCallback()
+			}
+		})
+
+		// the channel is destroyed before joined, exit it and join the new one
+		if manager.Get(name) == channel {
+			return channel, nil
+		}
+		manager.forget(session, name, channel)
+		channel.Exit(session)
+	}
+}
+
+// Exit a named channel.
+func (manager *ChannelManager) Exit(name string, session SessionAble) {
+	manager.mutex.RLock()
+	channel, exists := manager.memberships[session.Id()][name]
+	manager.mutex.RUnlock()
+
+	if exists {
+		manager.forget(session, name, channel)
+		channel.Exit(session)
+	}
+}
+
+// Exit all channels the session joined.
+func (manager *ChannelManager) ExitAll(session SessionAble) {
+	manager.mutex.Lock()
+	channels := manager.memberships[session.Id()]
+	delete(manager.memberships, session.Id())
+	manager.mutex.Unlock()
+
+	for _, channel := range channels {
+		channel.Exit(session)
+	}
+}
+
+// Kick out a session from a named channel.
+func (manager *ChannelManager) Kick(name string, sessionId uint64) {
+	manager.mutex.RLock()
+	channel, exists := manager.memberships[sessionId][name]
+	manager.mutex.RUnlock()
+
+	if exists {
+		channel.Kick(sessionId)
+	}
+}
+
+// Get names of the channels the session joined.
+func (manager *ChannelManager) ChannelsOf(sessionId uint64) []string {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	channels := manager.memberships[sessionId]
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Check the session is in a named channel or not.
+func (manager *ChannelManager) IsMember(name string, sessionId uint64) bool {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	_, exists := manager.memberships[sessionId][name]
+	return exists
+}
+
+// Get names of all channels.
+func (manager *ChannelManager) Names() []string {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	names := make([]string, 0, len(manager.channels))
+	for name := range manager.channels {
+		names = append(names, name)
+	}
+	return names
+}
+
+// How mush channels in this manager.
+func (manager *ChannelManager) Len() int {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	return len(manager.channels)
+}
+
+// How mush sessions joined at least one channel.
+func (manager *ChannelManager) SessionCount() int {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	return len(manager.memberships)
+}
+
+// Broadcast to the named channels. The message only encoded once and
+// a session joined more than one of the channels only receive it once.
+// The message is also published to the bound channels in other processes,
+// there a session joined more than one of the channels receives it more than once.
+func (manager *ChannelManager) Broadcast(names []string, message Message, timeout time.Duration) ([]BroadcastWork, error) {
+	manager.mutex.RLock()
+	channels := make([]*Channel, 0, len(names))
+	for _, name := range names {
+		if channel, exists := manager.channels[name]; exists {
+			channels = append(channels, channel)
+		}
+	}
+	manager.mutex.RUnlock()
+
+	return manager.broadcast(channels, message, timeout)
+}
+
+// Broadcast to all channels. A session only receive the message once.
+// The message is also published to the bound channels in other processes.
+func (manager *ChannelManager) BroadcastAll(message Message, timeout time.Duration) ([]BroadcastWork, error) {
+	manager.mutex.RLock()
+	channels := make([]*Channel, 0, len(manager.channels))
+	for _, channel := range manager.channels {
+		channels = append(channels, channel)
+	}
+	manager.mutex.RUnlock()
+
+	return manager.broadcast(channels, message, timeout)
+}
+
+func (manager *ChannelManager) broadcast(channels []*Channel, message Message, timeout time.Duration) ([]BroadcastWork, error) {
+	fetcher := func(callback func(SessionAble)) {
+		sent := make(map[uint64]struct{})
+		for _, channel := range channels {
+			channel.Fetch(func(session SessionAble) {
+				if _, exists := sent[session.Id()]; !exists {
+					sent[session.Id()] = struct{}{}
+					callback(session)
+				}
+			})
+		}
+	}
+	works, err := manager.broadcaster.broadcast(message, timeout, fetcher)
+	if err != nil {
+		return nil, err
+	}
+	return works, publishAll(channels, message)
+}
+
+// Create a channel and bind it to the bus. Don't hold the mutex, the bus may block.
+func (manager *ChannelManager) newChannel(name string, bus ChannelBus) (*Channel, error) {
+	channel := NewChannel(manager.protocol, manager.side)
+	if bus != nil {
+		if err := channel.BindBus(name, bus); err != nil {
+			return nil, err
+		}
+	}
+	return channel, nil
+}
+
+// Add a membership into the index. Must hold the mutex.
+// Returns true when the session is new to the manager and need a close callback.
+func (manager *ChannelManager) remember(session SessionAble, name string, channel *Channel) bool {
+	channels, exists := manager.memberships[session.Id()]
+	if !exists {
+		channels = make(map[string]*Channel)
+		manager.memberships[session.Id()] = channels
+	}
+	channels[name] = channel
+
+	if _, hooked := manager.hooked[session.Id()]; hooked {
+		return false
+	}
+	manager.hooked[session.Id()] = struct{}{}
+	return true
+}
+
+// Remove a membership from the index.
+// Nothing happen when the session already joined another channel with the same name.
+func (manager *ChannelManager) forget(session SessionAble, name string, channel *Channel) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	channels, exists := manager.memberships[session.Id()]
+	if exists && channels[name] == channel {
+		delete(channels, name)
+		if len(channels) == 0 {
+			delete(manager.memberships, session.Id())
+		}
+	}
+}
+
+// Remove a closed session from the manager.
+func (manager *ChannelManager) unhook(session SessionAble) {
+	manager.mutex.Lock()
+	delete(manager.hooked, session.Id())
+	manager.mutex.Unlock()
+
+	manager.ExitAll(session)
+}
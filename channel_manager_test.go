@@ -0,0 +1,232 @@
+package link
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPipeSessions(t *testing.T, id uint64) (server *Session, client *Session) {
+	serverConn, clientConn := net.Pipe()
+	server, err := NewSession(id, serverConn, DefaultProtocol, SERVER_SIDE, DefaultSendChanSize, 0)
+	assert.Nil(t, err)
+	client, err = NewSession(id, clientConn, DefaultProtocol, CLIENT_SIDE, DefaultSendChanSize, 0)
+	assert.Nil(t, err)
+	return
+}
+
+func TestChannelManagerMembership(t *testing.T) {
+	manager := NewChannelManager(DefaultProtocol, SERVER_SIDE)
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+
+	_, err := manager.Join("room1", session, nil)
+	assert.Nil(t, err)
+	_, err = manager.Join("room2", session, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, manager.Len())
+	assert.Equal(t, 1, manager.SessionCount())
+
+	names := manager.ChannelsOf(session.Id())
+	sort.Strings(names)
+	assert.Equal(t, []string{"room1", "room2"}, names)
+
+	manager.Exit("room1", session)
+	assert.False(t, manager.IsMember("room1", session.Id()))
+	assert.True(t, manager.IsMember("room2", session.Id()))
+	assert.Equal(t, 0, manager.Get("room1").Len())
+
+	kicked := false
+	_, err = manager.Join("room3", session, func() { kicked = true })
+	assert.Nil(t, err)
+	manager.Kick("room3", session.Id())
+	assert.True(t, kicked)
+	assert.False(t, manager.IsMember("room3", session.Id()))
+
+	session.Close()
+	assert.Equal(t, 0, manager.SessionCount())
+	assert.Equal(t, 0, manager.Get("room2").Len())
+}
+
+func TestChannelManagerDestroy(t *testing.T) {
+	manager := NewChannelManager(DefaultProtocol, SERVER_SIDE)
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+	defer session.Close()
+
+	channel, err := manager.Join("room", session, nil)
+	assert.Nil(t, err)
+	manager.Destroy("room")
+	assert.Nil(t, manager.Get("room"))
+	assert.Equal(t, 0, channel.Len())
+	assert.Equal(t, 0, manager.SessionCount())
+
+	_, err = manager.Create("room")
+	assert.Nil(t, err)
+	_, err = manager.Create("room")
+	assert.Equal(t, ChannelExistsError, err)
+}
+
+func TestChannelManagerJoinDestroy(t *testing.T) {
+	manager := NewChannelManager(DefaultProtocol, SERVER_SIDE)
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+	defer session.Close()
+
+	for i := 0; i < 1000; i++ {
+		done := make(chan struct{})
+		go func() {
+			manager.Destroy("room")
+			close(done)
+		}()
+		channel, err := manager.Join("room", session, nil)
+		assert.Nil(t, err)
+		<-done
+
+		// the session is never left in a destroyed channel
+		if current := manager.Get("room"); current != channel {
+			assert.Equal(t, 0, channel.Len())
+		} else {
+			assert.Equal(t, 1, channel.Len())
+			assert.True(t, manager.IsMember("room", session.Id()))
+		}
+	}
+}
+
+func TestChannelManagerBroadcast(t *testing.T) {
+	manager := NewChannelManager(DefaultProtocol, SERVER_SIDE)
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+	defer session.Close()
+
+	_, err := manager.Join("room1", session, nil)
+	assert.Nil(t, err)
+	_, err = manager.Join("room2", session, nil)
+	assert.Nil(t, err)
+
+	works, err := manager.Broadcast([]string{"room1", "room2"}, String("hello"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(works))
+
+	data, err := client.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.Nil(t, works[0].Wait())
+}
+
+// A bus in memory, the subscribing of the names in fails are failed.
+type fakeBus struct {
+	mutex     sync.Mutex
+	subs      map[string]int
+	published map[string]int
+	fails     map[string]bool
+}
+
+func newFakeBus(fails ...string) *fakeBus {
+	bus := &fakeBus{
+		subs:      make(map[string]int),
+		published: make(map[string]int),
+		fails:     make(map[string]bool),
+	}
+	for _, name := range fails {
+		bus.fails[name] = true
+	}
+	return bus
+}
+
+func (bus *fakeBus) Publish(name string, data []byte) error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.published[name]++
+	return nil
+}
+
+func (bus *fakeBus) Subscribe(name string, handler func(data []byte)) (func(), error) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if bus.fails[name] {
+		return nil, errors.New("subscribe failed")
+	}
+	bus.subs[name]++
+	return func() {
+		bus.mutex.Lock()
+		defer bus.mutex.Unlock()
+		bus.subs[name]--
+	}, nil
+}
+
+func (bus *fakeBus) count(counter map[string]int, name string) int {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	return counter[name]
+}
+
+func TestChannelManagerBusError(t *testing.T) {
+	manager := NewChannelManager(DefaultProtocol, SERVER_SIDE)
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+	defer session.Close()
+
+	assert.Nil(t, manager.SetBus(newFakeBus("bad")))
+
+	channel, err := manager.GetOrCreate("bad")
+	assert.NotNil(t, err)
+	assert.Nil(t, channel)
+	channel, err = manager.Join("bad", session, nil)
+	assert.NotNil(t, err)
+	assert.Nil(t, channel)
+	assert.Nil(t, manager.Get("bad"))
+	assert.Equal(t, 0, manager.Len())
+	assert.Equal(t, 0, manager.SessionCount())
+}
+
+func TestChannelManagerSetBusRollback(t *testing.T) {
+	manager := NewChannelManager(DefaultProtocol, SERVER_SIDE)
+	good := newFakeBus()
+	assert.Nil(t, manager.SetBus(good))
+	for _, name := range []string{"room1", "room2", "room3"} {
+		_, err := manager.Create(name)
+		assert.Nil(t, err)
+	}
+
+	bad := newFakeBus("room2")
+	assert.NotNil(t, manager.SetBus(bad))
+	for _, name := range []string{"room1", "room2", "room3"} {
+		assert.Equal(t, 1, good.count(good.subs, name))
+		assert.Equal(t, 0, bad.count(bad.subs, name))
+	}
+
+	// still bound to the old bus
+	_, err := manager.Create("room4")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, good.count(good.subs, "room4"))
+
+	assert.Nil(t, manager.SetBus(nil))
+	for _, name := range []string{"room1", "room2", "room3", "room4"} {
+		assert.Equal(t, 0, good.count(good.subs, name))
+	}
+}
+
+func TestChannelManagerBroadcastBus(t *testing.T) {
+	manager := NewChannelManager(DefaultProtocol, SERVER_SIDE)
+	bus := newFakeBus()
+	assert.Nil(t, manager.SetBus(bus))
+	for _, name := range []string{"room1", "room2"} {
+		_, err := manager.Create(name)
+		assert.Nil(t, err)
+	}
+
+	_, err := manager.Broadcast([]string{"room1"}, String("hello"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, bus.count(bus.published, "room1"))
+	assert.Equal(t, 0, bus.count(bus.published, "room2"))
+
+	_, err = manager.BroadcastAll(String("hello"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, bus.count(bus.published, "room1"))
+	assert.Equal(t, 1, bus.count(bus.published, "room2"))
+}
@@ -0,0 +1,112 @@
+package link
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func closeCallbackCount(session *Session) int {
+	return session.closeCallbacks.len()
+}
+
+func TestChannelMultiMembership(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+
+	channels := make([]*Channel, 10)
+	for i := range channels {
+		channels[i] = NewChannel(DefaultProtocol, SERVER_SIDE)
+		channels[i].Join(session, nil)
+	}
+	assert.Equal(t, len(channels), closeCallbackCount(session))
+
+	session.Close()
+	for _, channel := range channels {
+		assert.Equal(t, 0, channel.Len())
+	}
+}
+
+func TestChannelJoinExitCycles(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+
+	channel1 := NewChannel(DefaultProtocol, SERVER_SIDE)
+	channel2 := NewChannel(DefaultProtocol, SERVER_SIDE)
+	channel2.Join(session, nil)
+
+	kicks := 0
+	for i := 0; i < 5000; i++ {
+		channel1.Join(session, nil)
+		channel1.Join(session, nil)
+		channel1.Exit(session)
+
+		channel1.Join(session, func() { kicks++ })
+		channel1.Kick(session.Id())
+	}
+	assert.Equal(t, 5000, kicks)
+	assert.Equal(t, 0, channel1.Len())
+	assert.Equal(t, 1, closeCallbackCount(session))
+
+	channel1.Join(session, nil)
+	session.Close()
+	assert.Equal(t, 0, channel1.Len())
+	assert.Equal(t, 0, channel2.Len())
+
+	channel1.Join(session, nil)
+	assert.Equal(t, 0, channel1.Len())
+}
+
+func TestSessionRemoveCloseCallback(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+
+	called := 0
+	handle1 := session.AddCloseCallback(func() { called += 1 })
+	handle2 := session.AddCloseCallback(func() { called += 10 })
+	assert.NotEqual(t, handle1, handle2)
+
+	session.RemoveCloseCallback(handle1)
+	session.RemoveCloseCallback(handle1)
+	session.Close()
+	assert.Equal(t, 10, called)
+
+	assert.Equal(t, CloseCallbackHandle(0), session.AddCloseCallback(func() {}))
+}
+
+func TestChannelMemberMeta(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+	defer session.Close()
+
+	channel := NewChannel(DefaultProtocol, SERVER_SIDE)
+	kicked := false
+	channel.JoinWithMeta(session, "nickname", func() { kicked = true })
+
+	member, exists := channel.Member(session.Id())
+	assert.True(t, exists)
+	assert.Equal(t, "nickname", member.Meta)
+	assert.False(t, member.Muted)
+
+	assert.True(t, channel.UpdateMember(session.Id(), func(member *ChannelMember) {
+		member.Role = "admin"
+		member.Team = "red"
+		member.Muted = true
+	}))
+	assert.False(t, channel.UpdateMember(session.Id()+1, func(*ChannelMember) {}))
+
+	var members []ChannelMember
+	channel.FetchMembers(func(member ChannelMember) {
+		members = append(members, member)
+	})
+	assert.Equal(t, 1, len(members))
+	assert.Equal(t, "admin", members[0].Role)
+	assert.Equal(t, "red", members[0].Team)
+	assert.True(t, members[0].Muted)
+	assert.Equal(t, "nickname", members[0].Meta)
+
+	channel.Kick(session.Id())
+	assert.True(t, kicked)
+	_, exists = channel.Member(session.Id())
+	assert.False(t, exists)
+}
@@ -0,0 +1,486 @@
+package link
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Errors
+var (
+	BadFragmentError      = errors.New("Bad fragment")
+	FragmentTooLargeError = errors.New("Reassembled message too large")
+	TooManyPartialsError  = errors.New("Too many partial messages")
+	StreamAbortedError    = errors.New("Stream message aborted")
+	StreamSizeError       = errors.New("Stream message size mismatch")
+	TooManyStreamsError   = errors.New("Too many stream messages")
+)
+
+var (
+	DefaultFragmentSize       = 16 * 1024        // Default max payload size of one fragment.
+	DefaultMaxReassembledSize = 16 * 1024 * 1024 // Default max size of a reassembled message.
+	DefaultMaxPartials        = 16               // Default max partial messages of a session.
+	DefaultMaxPartialsSize    = 32 * 1024 * 1024 // Default max buffered bytes of the partial messages of a session.
+	DefaultMaxStreams         = 16               // Default max incoming stream messages of a session.
+	DefaultStreamBufferSize   = 256              // Default max buffered fragments of an incoming stream message.
+)
+
+// {kind:uint8}{payload} for the whole message.
+// {kind:uint8}{message id:uvarint}{total size:uvarint}{payload} for the first fragment.
+// {kind:uint8}{message id:uvarint}{payload} for the others.
+// The total size of stream begin fragment is the message size + 1, so 0 means unknown size.
+const (
+	fragmentWhole       = 0
+	fragmentFirst       = 1
+	fragmentMore        = 2
+	fragmentLast        = 3
+	fragmentStreamBegin = 4
+	fragmentStreamData  = 5
+	fragmentStreamEnd   = 6
+	fragmentStreamAbort = 7
+)
+
+type wholeFragment struct {
+	message Message
+}
+
+func (fragment wholeFragment) Size() int {
+	return 1 + fragment.message.Size()
+}
+
+func (fragment wholeFragment) MarshalTo(buffer []byte) (n int, err error) {
+	if len(buffer) < 1 {
+		return 0, BufferSizeNotEnough
+	}
+	buffer[0] = fragmentWhole
+	n, err = fragment.message.MarshalTo(buffer[1:])
+	return n + 1, err
+}
+
+type chunkFragment struct {
+	kind  uint8
+	id    uint64
+	total int64
+	data  []byte
+}
+
+func (fragment chunkFragment) hasTotal() bool {
+	return fragment.kind == fragmentFirst || fragment.kind == fragmentStreamBegin
+}
+
+func (fragment chunkFragment) headSize() int {
+	var head [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(head[:], fragment.id)
+	if fragment.hasTotal() {
+		n += binary.PutUvarint(head[n:], uint64(fragment.total))
+	}
+	return 1 + n
+}
+
+func (fragment chunkFragment) Size() int {
+	return fragment.headSize() + len(fragment.data)
+}
+
+func (fragment chunkFragment) MarshalTo(buffer []byte) (n int, err error) {
+	if len(buffer) < fragment.Size() {
+		return 0, BufferSizeNotEnough
+	}
+	buffer[0] = fragment.kind
+	n = 1 + binary.PutUvarint(buffer[1:], fragment.id)
+	if fragment.hasTotal() {
+		n += binary.PutUvarint(buffer[n:], uint64(fragment.total))
+	}
+	n += copy(buffer[n:], fragment.data)
+	return
+}
+
+// The fragmentation layer of a session.
+// Messages bigger than the fragment size are split into fragments,
+// each fragment is sent as a packet, so the other messages can be sent between fragments.
+// Both sides of the session must send and decode packets by fragmenter.
+type Fragmenter struct {
+	session        SessionAble
+	fragmentSize   int
+	maxMessageSize int
+	lastId         uint64
+
+	mutex         sync.Mutex
+	partials      map[uint64]*partialMessage
+	partialsSize  int                      // How mush bytes buffered by the partial messages.
+	streams       map[uint64]*streamReader // nil reader means the rest of stream is discarded
+	streamHandler func(reader io.Reader, size int64)
+
+	// The limits of the partial messages and stream messages, the session will be closed when exceeded.
+	MaxPartials     int
+	MaxPartialsSize int
+	MaxStreams      int
+
+	// The max buffered fragments of an incoming stream message,
+	// the stream is aborted when the handler can't read as fast as it arriving.
+	StreamBufferSize int
+}
+
+type partialMessage struct {
+	data  []byte
+	total int
+}
+
+// Create a fragmenter. The max message size limit the reassembled message size.
+func NewFragmenter(session SessionAble, fragmentSize, maxMessageSize int) *Fragmenter {
+	fragmenter := &Fragmenter{
+		session:          session,
+		fragmentSize:     fragmentSize,
+		maxMessageSize:   maxMessageSize,
+		partials:         make(map[uint64]*partialMessage),
+		streams:          make(map[uint64]*streamReader),
+		MaxPartials:      DefaultMaxPartials,
+		MaxPartialsSize:  DefaultMaxPartialsSize,
+		MaxStreams:       DefaultMaxStreams,
+		StreamBufferSize: DefaultStreamBufferSize,
+	}
+	session.AddCloseCallback(fragmenter.abortStreams)
+	return fragmenter
+}
+
+// Get session.
+func (fragmenter *Fragmenter) Session() SessionAble {
+	return fragmenter.session
+}
+
+// Sync send a message, split it when it is bigger than the fragment size.
+func (fragmenter *Fragmenter) Send(message Message) error {
+	size := message.Size()
+	if size <= fragmenter.fragmentSize {
+		return fragmenter.session.SendNow(wholeFragment{message})
+	}
+
+	data := make([]byte, size)
+	n, err := message.MarshalTo(data)
+	if err != nil {
+		return err
+	}
+	data = data[:n]
+	if n <= fragmenter.fragmentSize {
+		// the size is only an estimate
+		return fragmenter.session.SendNow(wholeFragment{BytesMessage(data)})
+	}
+
+	id := atomic.AddUint64(&fragmenter.lastId, 1)
+	for offset := 0; offset < len(data); offset += fragmenter.fragmentSize {
+		end := offset + fragmenter.fragmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+		kind := uint8(fragmentMore)
+		switch {
+		case offset == 0:
+			kind = fragmentFirst
+		case end == len(data):
+			kind = fragmentLast
+		}
+		if err := fragmenter.session.SendNow(chunkFragment{kind, id, int64(len(data)), data[offset:end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync send a stream message piece by piece, the message is never buffered as a whole.
+// The other messages can be sent between the pieces.
+// Returns StreamSizeError when the written data don't match the size, the receiver get StreamAbortedError then.
+func (fragmenter *Fragmenter) SendStream(message StreamMessage) error {
+	id := atomic.AddUint64(&fragmenter.lastId, 1)
+	size := message.Size()
+	if err := fragmenter.session.SendNow(chunkFragment{fragmentStreamBegin, id, size + 1, nil}); err != nil {
+		return err
+	}
+	n, err := message.WriteTo(&streamWriter{fragmenter, id})
+	if err == nil && size >= 0 && n != size {
+		err = StreamSizeError
+	}
+	if err != nil {
+		fragmenter.session.SendNow(chunkFragment{fragmentStreamAbort, id, 0, nil})
+		return err
+	}
+	return fragmenter.session.SendNow(chunkFragment{fragmentStreamEnd, id, 0, nil})
+}
+
+type streamWriter struct {
+	fragmenter *Fragmenter
+	id         uint64
+}
+
+func (writer *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + writer.fragmenter.fragmentSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := writer.fragmenter.session.SendNow(chunkFragment{fragmentStreamData, writer.id, 0, p[written:end]}); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// Set the handler of stream messages. Each stream message invoke the handler in a new goroutine,
+// the size is -1 when the sender don't known it. The reader returns io.EOF at the end of message,
+// returns StreamAbortedError when the sender failed, the session closed or the handler is too slow,
+// returns StreamSizeError when the received data don't match the size.
+// The session reading never waits the handler, the data is buffered up to StreamBufferSize fragments,
+// and the rest of the message is discarded when the handler returns.
+func (fragmenter *Fragmenter) HandleStream(handler func(reader io.Reader, size int64)) {
+	fragmenter.mutex.Lock()
+	defer fragmenter.mutex.Unlock()
+
+	fragmenter.streamHandler = handler
+}
+
+// Wrap a decoder, the next decoder will receive the reassembled messages.
+// The session will be closed when it received a bad fragment or a too large message.
+func (fragmenter *Fragmenter) Decode(next Decoder) Decoder {
+	return func(msg *InBuffer) error {
+		if len(msg.Data) > 0 && msg.Data[0] >= fragmentStreamBegin {
+			if err := fragmenter.receiveStream(msg.Data); err != nil {
+				fragmenter.session.Close()
+				return err
+			}
+			return nil
+		}
+		data, err := fragmenter.reassemble(msg.Data)
+		if err != nil {
+			fragmenter.session.Close()
+			return err
+		}
+		if data == nil {
+			return nil
+		}
+		return next(&InBuffer{Data: data})
+	}
+}
+
+// Returns nil data when the message is not complete.
+func (fragmenter *Fragmenter) reassemble(packet []byte) ([]byte, error) {
+	if len(packet) < 1 {
+		return nil, BadFragmentError
+	}
+	kind := packet[0]
+	if kind == fragmentWhole {
+		return packet[1:], nil
+	}
+
+	id, n := binary.Uvarint(packet[1:])
+	if n <= 0 {
+		return nil, BadFragmentError
+	}
+	payload := packet[1+n:]
+
+	fragmenter.mutex.Lock()
+	defer fragmenter.mutex.Unlock()
+
+	partial, exists := fragmenter.partials[id]
+	switch kind {
+	case fragmentFirst:
+		total, n := binary.Uvarint(payload)
+		if n <= 0 || exists {
+			return nil, BadFragmentError
+		}
+		if total > uint64(fragmenter.maxMessageSize) {
+			return nil, FragmentTooLargeError
+		}
+		if fragmenter.MaxPartials > 0 && len(fragmenter.partials) >= fragmenter.MaxPartials {
+			return nil, TooManyPartialsError
+		}
+		payload = payload[n:]
+		// don't trust the total, the buffer grows as the fragments arrive
+		partial = &partialMessage{nil, int(total)}
+		fragmenter.partials[id] = partial
+	case fragmentMore, fragmentLast:
+		if !exists {
+			return nil, BadFragmentError
+		}
+	default:
+		return nil, BadFragmentError
+	}
+
+	if len(partial.data)+len(payload) > partial.total {
+		return nil, BadFragmentError
+	}
+	if fragmenter.MaxPartialsSize > 0 && fragmenter.partialsSize+len(payload) > fragmenter.MaxPartialsSize {
+		return nil, FragmentTooLargeError
+	}
+	partial.data = append(partial.data, payload...)
+	fragmenter.partialsSize += len(payload)
+
+	if kind != fragmentLast {
+		return nil, nil
+	}
+	delete(fragmenter.partials, id)
+	fragmenter.partialsSize -= len(partial.data)
+	if len(partial.data) != partial.total {
+		return nil, BadFragmentError
+	}
+	return partial.data, nil
+}
+
+func (fragmenter *Fragmenter) receiveStream(packet []byte) error {
+	kind := packet[0]
+	id, n := binary.Uvarint(packet[1:])
+	if n <= 0 {
+		return BadFragmentError
+	}
+	payload := packet[1+n:]
+
+	fragmenter.mutex.Lock()
+	reader, exists := fragmenter.streams[id]
+	switch kind {
+	case fragmentStreamBegin:
+		total, n := binary.Uvarint(payload)
+		if n <= 0 || exists || fragmenter.streamHandler == nil {
+			fragmenter.mutex.Unlock()
+			return BadFragmentError
+		}
+		if fragmenter.MaxStreams > 0 && len(fragmenter.streams) >= fragmenter.MaxStreams {
+			fragmenter.mutex.Unlock()
+			return TooManyStreamsError
+		}
+		reader = newStreamReader(int64(total)-1, fragmenter.StreamBufferSize)
+		fragmenter.streams[id] = reader
+		go func(handler func(io.Reader, int64)) {
+			handler(reader, reader.size)
+			close(reader.handled)
+		}(fragmenter.streamHandler)
+	case fragmentStreamEnd, fragmentStreamAbort:
+		delete(fragmenter.streams, id)
+	}
+	fragmenter.mutex.Unlock()
+
+	switch kind {
+	case fragmentStreamData:
+		if !exists {
+			return BadFragmentError
+		}
+		if reader != nil && !reader.push(payload) {
+			// the handler returned or the stream failed, discard the rest
+			fragmenter.mutex.Lock()
+			if _, exists := fragmenter.streams[id]; exists {
+				fragmenter.streams[id] = nil
+			}
+			fragmenter.mutex.Unlock()
+		}
+	case fragmentStreamEnd:
+		if !exists {
+			return BadFragmentError
+		}
+		if reader != nil {
+			if reader.size >= 0 && reader.received != reader.size {
+				reader.finish(StreamSizeError)
+			} else {
+				reader.finish(io.EOF)
+			}
+		}
+	case fragmentStreamAbort:
+		if !exists {
+			return BadFragmentError
+		}
+		if reader != nil {
+			reader.finish(StreamAbortedError)
+		}
+	case fragmentStreamBegin:
+	default:
+		return BadFragmentError
+	}
+	return nil
+}
+
+func (fragmenter *Fragmenter) abortStreams() {
+	fragmenter.mutex.Lock()
+	streams := fragmenter.streams
+	fragmenter.streams = make(map[uint64]*streamReader)
+	fragmenter.mutex.Unlock()
+
+	for _, reader := range streams {
+		if reader != nil {
+			reader.finish(StreamAbortedError)
+		}
+	}
+}
+
+// The reader of an incoming stream message. The fragments are pushed by the session reading goroutine.
+type streamReader struct {
+	size     int64
+	received int64 // only used by the session reading goroutine
+	chunks   chan []byte
+	current  []byte
+	handled  chan struct{} // closed when the handler returned
+
+	endOnce sync.Once
+	ended   chan struct{}
+	err     error
+}
+
+func newStreamReader(size int64, bufferSize int) *streamReader {
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+	return &streamReader{
+		size:    size,
+		chunks:  make(chan []byte, bufferSize),
+		handled: make(chan struct{}),
+		ended:   make(chan struct{}),
+	}
+}
+
+// Returns false when the stream can't accept more data.
+func (reader *streamReader) push(data []byte) bool {
+	if reader.size >= 0 && reader.received+int64(len(data)) > reader.size {
+		reader.finish(StreamSizeError)
+		return false
+	}
+	select {
+	case <-reader.handled:
+		return false
+	case <-reader.ended:
+		return false
+	default:
+	}
+	select {
+	case reader.chunks <- append([]byte(nil), data...):
+		reader.received += int64(len(data))
+		return true
+	default:
+		// the handler is too slow
+		reader.finish(StreamAbortedError)
+		return false
+	}
+}
+
+// No more data, err is io.EOF when the stream completed.
+func (reader *streamReader) finish(err error) {
+	reader.endOnce.Do(func() {
+		reader.err = err
+		close(reader.ended)
+	})
+}
+
+func (reader *streamReader) Read(p []byte) (int, error) {
+	if len(reader.current) == 0 {
+		select {
+		case reader.current = <-reader.chunks:
+		case <-reader.ended:
+			// the data received before the end
+			select {
+			case reader.current = <-reader.chunks:
+			default:
+				return 0, reader.err
+			}
+		}
+	}
+	n := copy(p, reader.current)
+	reader.current = reader.current[n:]
+	return n, nil
+}
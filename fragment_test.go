@@ -0,0 +1,280 @@
+package link
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketSizeOverflow(t *testing.T) {
+	state, _ := PacketN(2, LittleEndian, 0, 0).New(nil, CLIENT_SIDE)
+
+	var buffer OutBuffer
+	assert.Nil(t, state.WriteToBuffer(&buffer, Bytes(make([]byte, 0xFFFF))))
+	buffer.reset()
+	assert.Equal(t, PacketSizeOverflowError, state.WriteToBuffer(&buffer, Bytes(make([]byte, 0x10000))))
+}
+
+func TestFragmenter(t *testing.T) {
+	protocol := PacketN(2, LittleEndian, 0, 0)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := NewServer(listener, protocol)
+	defer server.Stop()
+
+	received := make(chan []byte, 10)
+	go server.Serve(func(session SessionAble) {
+		fragmenter := NewFragmenter(session, 1000, 1024*1024)
+		session.Process(fragmenter.Decode(func(msg *InBuffer) error {
+			received <- append([]byte(nil), msg.Data...)
+			return nil
+		}))
+	})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	session, err := NewSession(1, conn, protocol, CLIENT_SIDE, DefaultSendChanSize, DefaultConnBufferSize)
+	assert.Nil(t, err)
+	defer session.Close()
+
+	// the 2 bytes header can't present the size
+	assert.Equal(t, PacketSizeOverflowError, session.SendNow(Bytes(make([]byte, 100000))))
+
+	fragmenter := NewFragmenter(session, 1000, 1024*1024)
+	sizes := []int{0, 1, 999, 1000, 1001, 2000, 100000, 200000}
+	messages := make(map[string]bool)
+	var wg sync.WaitGroup
+	for _, size := range sizes {
+		data := make([]byte, size)
+		rand.Read(data)
+		messages[string(data)] = true
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, fragmenter.Send(Bytes(data)))
+		}()
+	}
+	wg.Wait()
+
+	for range sizes {
+		data := <-received
+		assert.True(t, messages[string(data)], "size %d", len(data))
+		delete(messages, string(data))
+	}
+}
+
+func TestFragmenterBadFragment(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+
+	fragmenter := NewFragmenter(session, 10, 15)
+	var received []byte
+	decode := fragmenter.Decode(func(msg *InBuffer) error {
+		received = msg.Data
+		return nil
+	})
+
+	assert.Nil(t, decode(&InBuffer{Data: fragmentPacket(t, chunkFragment{fragmentFirst, 1, 15, bytes.Repeat([]byte{1}, 10)})}))
+	assert.Nil(t, received)
+	assert.Nil(t, decode(&InBuffer{Data: fragmentPacket(t, chunkFragment{fragmentLast, 1, 0, bytes.Repeat([]byte{1}, 5)})}))
+	assert.Equal(t, bytes.Repeat([]byte{1}, 15), received)
+
+	_, err := fragmenter.reassemble(fragmentPacket(t, chunkFragment{fragmentMore, 2, 0, make([]byte, 10)}))
+	assert.Equal(t, BadFragmentError, err)
+
+	assert.False(t, session.IsClosed())
+	assert.Equal(t, FragmentTooLargeError, decode(&InBuffer{Data: fragmentPacket(t, chunkFragment{fragmentFirst, 3, 16, make([]byte, 10)})}))
+	assert.True(t, session.IsClosed())
+}
+
+func TestFragmenterLimits(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+
+	fragmenter := NewFragmenter(session, 10, 100)
+	fragmenter.MaxPartials = 2
+	fragmenter.MaxPartialsSize = 25
+	decode := fragmenter.Decode(func(msg *InBuffer) error {
+		return nil
+	})
+
+	assert.Nil(t, decode(&InBuffer{Data: fragmentPacket(t, chunkFragment{fragmentFirst, 1, 100, make([]byte, 10)})}))
+	// the buffer is not allocated by the total
+	assert.True(t, cap(fragmenter.partials[1].data) < 100)
+	assert.Nil(t, decode(&InBuffer{Data: fragmentPacket(t, chunkFragment{fragmentFirst, 2, 100, make([]byte, 10)})}))
+	assert.Equal(t, TooManyPartialsError, decode(&InBuffer{Data: fragmentPacket(t, chunkFragment{fragmentFirst, 3, 100, make([]byte, 10)})}))
+	assert.True(t, session.IsClosed())
+
+	fragmenter = NewFragmenter(session, 10, 100)
+	fragmenter.MaxPartialsSize = 25
+	_, err := fragmenter.reassemble(fragmentPacket(t, chunkFragment{fragmentFirst, 1, 100, make([]byte, 10)}))
+	assert.Nil(t, err)
+	_, err = fragmenter.reassemble(fragmentPacket(t, chunkFragment{fragmentFirst, 2, 100, make([]byte, 10)}))
+	assert.Nil(t, err)
+	_, err = fragmenter.reassemble(fragmentPacket(t, chunkFragment{fragmentMore, 1, 0, make([]byte, 10)}))
+	assert.Equal(t, FragmentTooLargeError, err)
+}
+
+// A message its size is bigger than the marshaled data.
+type estimatedMessage []byte
+
+func (message estimatedMessage) Size() int {
+	return len(message) * 2
+}
+
+func (message estimatedMessage) MarshalTo(buffer []byte) (int, error) {
+	return copy(buffer, message), nil
+}
+
+func TestFragmenterEstimatedSize(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+	defer session.Close()
+
+	fragmenter := NewFragmenter(session, 10, 100)
+	go fragmenter.Send(estimatedMessage("0123456789"))
+	packet, err := client.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, append([]byte{fragmentWhole}, "0123456789"...), packet)
+
+	go fragmenter.Send(estimatedMessage("0123456789a"))
+	var data []byte
+	for _, kind := range []uint8{fragmentFirst, fragmentLast} {
+		packet, err := client.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, kind, packet[0])
+		data, err = fragmenter.reassemble(packet)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, "0123456789a", string(data))
+}
+
+func fragmentPacket(t *testing.T, fragment chunkFragment) []byte {
+	packet := make([]byte, fragment.Size())
+	n, err := fragment.MarshalTo(packet)
+	assert.Nil(t, err)
+	return packet[:n]
+}
+
+func TestFragmenterStream(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+
+	type result struct {
+		data []byte
+		size int64
+		err  error
+	}
+	results := make(chan result, 10)
+	messages := make(chan []byte, 10)
+
+	fragmenter := NewFragmenter(session, 1000, 1000)
+	fragmenter.StreamBufferSize = 2048 // the whole message, so the handler is never too slow
+	fragmenter.HandleStream(func(reader io.Reader, size int64) {
+		if size == 1 {
+			// give up the stream
+			return
+		}
+		data, err := io.ReadAll(reader)
+		results <- result{data, size, err}
+	})
+	go session.Process(fragmenter.Decode(func(msg *InBuffer) error {
+		messages <- append([]byte(nil), msg.Data...)
+		return nil
+	}))
+
+	clientFragmenter := NewFragmenter(client, 1000, 1000)
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+
+	assert.Nil(t, clientFragmenter.SendStream(ReaderMessage(bytes.NewReader(data), int64(len(data)))))
+	r := <-results
+	assert.Nil(t, r.err)
+	assert.Equal(t, int64(len(data)), r.size)
+	assert.True(t, bytes.Equal(data, r.data))
+
+	assert.Nil(t, clientFragmenter.SendStream(ReaderMessage(bytes.NewReader(data[:5000]), -1)))
+	r = <-results
+	assert.Nil(t, r.err)
+	assert.Equal(t, int64(-1), r.size)
+	assert.Equal(t, data[:5000], r.data)
+
+	// the reader is shorter than the size
+	assert.Equal(t, io.ErrUnexpectedEOF, clientFragmenter.SendStream(ReaderMessage(bytes.NewReader(data[:10]), 20)))
+	r = <-results
+	assert.Equal(t, StreamAbortedError, r.err)
+	assert.Equal(t, data[:10], r.data)
+
+	// the handler returns without reading, the rest is discarded
+	assert.Nil(t, clientFragmenter.SendStream(ReaderMessage(bytes.NewReader(data[:1]), 1)))
+	assert.Nil(t, clientFragmenter.Send(String("hello")))
+	assert.Equal(t, "hello", string(<-messages))
+
+	// the session closed in the middle of a stream
+	reader, writer := io.Pipe()
+	go clientFragmenter.SendStream(ReaderMessage(reader, -1))
+	writer.Write([]byte("abc"))
+	client.Close()
+	r = <-results
+	assert.Equal(t, StreamAbortedError, r.err)
+	writer.Close()
+}
+
+func TestFragmenterStreamLimits(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 10)
+	start := make(chan struct{})
+	fragmenter := NewFragmenter(session, 10, 100)
+	fragmenter.MaxStreams = 2
+	fragmenter.StreamBufferSize = 2
+	fragmenter.HandleStream(func(reader io.Reader, size int64) {
+		<-start
+		data, err := io.ReadAll(reader)
+		results <- result{data, err}
+	})
+	decode := fragmenter.Decode(func(msg *InBuffer) error {
+		return nil
+	})
+	send := func(fragment chunkFragment) error {
+		return decode(&InBuffer{Data: fragmentPacket(t, fragment)})
+	}
+
+	// the data is shorter than the size
+	assert.Nil(t, send(chunkFragment{fragmentStreamBegin, 1, 6, nil}))
+	assert.Nil(t, send(chunkFragment{fragmentStreamData, 1, 0, []byte("abc")}))
+	assert.Nil(t, send(chunkFragment{fragmentStreamEnd, 1, 0, nil}))
+	start <- struct{}{}
+	r := <-results
+	assert.Equal(t, StreamSizeError, r.err)
+	assert.Equal(t, "abc", string(r.data))
+
+	// the handler is too slow, the decoder don't wait it
+	assert.Nil(t, send(chunkFragment{fragmentStreamBegin, 2, 0, nil}))
+	for _, data := range []string{"abc", "def", "ghi"} {
+		assert.Nil(t, send(chunkFragment{fragmentStreamData, 2, 0, []byte(data)}))
+	}
+	assert.Nil(t, send(chunkFragment{fragmentStreamEnd, 2, 0, nil}))
+	start <- struct{}{}
+	r = <-results
+	assert.Equal(t, StreamAbortedError, r.err)
+	assert.Equal(t, "abcdef", string(r.data))
+
+	assert.Nil(t, send(chunkFragment{fragmentStreamBegin, 3, 0, nil}))
+	assert.Nil(t, send(chunkFragment{fragmentStreamBegin, 4, 0, nil}))
+	assert.False(t, session.IsClosed())
+	assert.Equal(t, TooManyStreamsError, send(chunkFragment{fragmentStreamBegin, 5, 0, nil}))
+	assert.True(t, session.IsClosed())
+	close(start)
+}
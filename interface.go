@@ -8,8 +8,8 @@ type SessionAble interface {
 	Conn() net.Conn
 	IsClosed() bool
 
-	AddCloseCallback(handler interface{}, callback func())
-	RemoveCloseCallback(handler interface{})
+	AddCloseCallback(callback func()) CloseCallbackHandle
+	RemoveCloseCallback(handle CloseCallbackHandle)
 
 	SendDefault(message Message) error
 	SendNow(message Message) error
@@ -1,9 +1,10 @@
 package link
 
 import (
-// "encoding/gob"
-// "encoding/json"
-// "encoding/xml"
+	"io"
+	// "encoding/gob"
+	// "encoding/json"
+	// "encoding/xml"
 )
 
 type Message interface {
@@ -41,6 +42,40 @@ func String(str string) (m Message) {
 	return Bytes([]byte(str))
 }
 
+// The message too large to buffer, it writes itself into a writer piece by piece.
+// Send it by Fragmenter.SendStream.
+type StreamMessage interface {
+	// The message size, -1 when the size is unknown.
+	Size() int64
+	WriteTo(w io.Writer) (n int64, err error)
+}
+
+// Create a stream message from a reader, like a file.
+// The size can be -1, then the message ends when the reader returns io.EOF.
+func ReaderMessage(reader io.Reader, size int64) StreamMessage {
+	return readerMessage{reader, size}
+}
+
+type readerMessage struct {
+	reader io.Reader
+	size   int64
+}
+
+func (message readerMessage) Size() int64 {
+	return message.size
+}
+
+func (message readerMessage) WriteTo(w io.Writer) (n int64, err error) {
+	if message.size < 0 {
+		return io.Copy(w, message.reader)
+	}
+	n, err = io.CopyN(w, message.reader, message.size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
 // // Convert to string message.
 // func String(v string) Message {
 // 	return MessageFunc(func(buffer *OutBuffer) error {
@@ -0,0 +1,124 @@
+package link
+
+import (
+	"errors"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Errors
+var (
+	RateLimitError = errors.New("Message rate limit exceeded")
+)
+
+// Wrap a decoder. It is applied once in each session, so the state created
+// outside the returned decoder belongs to one session.
+type DecoderMiddleware func(next Decoder) Decoder
+
+// How the session handle the error returned by decoder.
+type DecoderErrorPolicy int
+
+const (
+	CloseOnDecoderError DecoderErrorPolicy = iota // Close the session and return the error from Process.
+	LogOnDecoderError                             // Log the error and continue processing.
+	IgnoreDecoderError                            // Continue processing.
+)
+
+var DefaultDecoderErrorPolicy = IgnoreDecoderError // Default policy for new sessions, the errors are ignored as before.
+
+// Returns non-nil error when the session should stop processing.
+func (policy DecoderErrorPolicy) handle(session SessionAble, err error) error {
+	switch policy {
+	case LogOnDecoderError:
+		log.Printf("link: session %d decode failed: %v", session.Id(), err)
+		return nil
+	case IgnoreDecoderError:
+		return nil
+	}
+	session.Close()
+	return err
+}
+
+func chainDecoder(decoder Decoder, middlewares []DecoderMiddleware) Decoder {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		decoder = middlewares[i](decoder)
+	}
+	return decoder
+}
+
+// The middlewares of a session. The chain is built once, so the middlewares keep
+// their state across ProcessOnce calls, and the decoder of each call is put at the end.
+type decoderChain struct {
+	middlewares []DecoderMiddleware
+	chained     Decoder
+	decoder     Decoder
+}
+
+func (chain *decoderChain) use(middlewares ...DecoderMiddleware) {
+	chain.middlewares = append(chain.middlewares, middlewares...)
+	chain.chained = nil
+}
+
+// Must hold the read mutex of session.
+func (chain *decoderChain) wrap(decoder Decoder) Decoder {
+	if len(chain.middlewares) == 0 {
+		return decoder
+	}
+	chain.decoder = decoder
+	if chain.chained == nil {
+		chain.chained = chainDecoder(func(msg *InBuffer) error {
+			return chain.decoder(msg)
+		}, chain.middlewares)
+	}
+	return chain.chained
+}
+
+// Recover the panic of decoder, returns the panic as *PanicError.
+func RecoverDecoder() DecoderMiddleware {
+	return func(next Decoder) Decoder {
+		return func(msg *InBuffer) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					err = &PanicError{v, debug.Stack()}
+				}
+			}()
+			return next(msg)
+		}
+	}
+}
+
+// Report the time cost of each message.
+func TimeDecoder(observe func(duration time.Duration, err error)) DecoderMiddleware {
+	return func(next Decoder) Decoder {
+		return func(msg *InBuffer) error {
+			startTime := time.Now()
+			err := next(msg)
+			observe(time.Since(startTime), err)
+			return err
+		}
+	}
+}
+
+// Limit the message rate of each session by token bucket.
+// The rate is messages per second, the burst is the bucket size.
+// Returns RateLimitError when a message exceed the limit.
+func RateLimitDecoder(rate float64, burst int) DecoderMiddleware {
+	return func(next Decoder) Decoder {
+		tokens := float64(burst)
+		lastTime := time.Now()
+		return func(msg *InBuffer) error {
+			now := time.Now()
+			tokens += now.Sub(lastTime).Seconds() * rate
+			if tokens > float64(burst) {
+				tokens = float64(burst)
+			}
+			lastTime = now
+			if tokens < 1 {
+				return RateLimitError
+			}
+			tokens--
+			return next(msg)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package link
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerMiddleware(t *testing.T) {
+	server, err := Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	server.DecoderErrorPolicy = CloseOnDecoderError
+	var timed int32
+	server.Use(RecoverDecoder(), TimeDecoder(func(duration time.Duration, err error) {
+		atomic.AddInt32(&timed, 1)
+	}))
+	processErrors := make(chan error, 1)
+	go server.Serve(func(session SessionAble) {
+		processErrors <- session.Process(func(msg *InBuffer) error {
+			if string(msg.Data) == "panic" {
+				panic("oops")
+			}
+			return session.SendNow(Bytes(msg.Data))
+		})
+	})
+
+	client, err := Dial("tcp", server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	assert.Nil(t, client.SendNow(String("hello")))
+	data, err := client.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// the decoder error close the session
+	assert.Nil(t, client.SendNow(String("panic")))
+	err = <-processErrors
+	assert.IsType(t, &PanicError{}, err)
+	_, err = client.ReadPacket()
+	assert.NotNil(t, err)
+	// the panic skipped the inner timing middleware
+	assert.Equal(t, int32(1), atomic.LoadInt32(&timed))
+	waitUntil(t, func() bool {
+		return server.GetSessionCount() == 0
+	})
+}
+
+func TestDecoderErrorPolicy(t *testing.T) {
+	badMessage := errors.New("Bad message")
+	for _, policy := range []DecoderErrorPolicy{LogOnDecoderError, IgnoreDecoderError} {
+		session, client := newPipeSessions(t, 1)
+		session.SetDecoderErrorPolicy(policy)
+		go func() {
+			client.SendNow(String("bad"))
+			client.SendNow(String("good"))
+		}()
+
+		var received []string
+		decoder := func(msg *InBuffer) error {
+			received = append(received, string(msg.Data))
+			if string(msg.Data) == "bad" {
+				return badMessage
+			}
+			return nil
+		}
+		assert.Nil(t, session.ProcessOnce(decoder))
+		assert.Nil(t, session.ProcessOnce(decoder))
+		assert.False(t, session.IsClosed())
+		assert.Equal(t, []string{"bad", "good"}, received)
+		client.Close()
+	}
+}
+
+func TestDecoderChainState(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+	assert.Equal(t, IgnoreDecoderError, session.decoderErrorPolicy)
+	session.SetDecoderErrorPolicy(CloseOnDecoderError)
+	session.Use(RateLimitDecoder(0.001, 2))
+	go func() {
+		for i := 0; i < 3; i++ {
+			client.SendNow(String("hello"))
+		}
+	}()
+
+	// the bucket is shared by the ProcessOnce calls
+	var received int
+	decoder := func(msg *InBuffer) error {
+		received++
+		return nil
+	}
+	assert.Nil(t, session.ProcessOnce(decoder))
+	assert.Nil(t, session.ProcessOnce(decoder))
+	assert.Equal(t, RateLimitError, session.ProcessOnce(decoder))
+	assert.Equal(t, 2, received)
+	assert.True(t, session.IsClosed())
+}
+
+func TestRateLimitDecoder(t *testing.T) {
+	decoder := RateLimitDecoder(1000, 3)(func(*InBuffer) error {
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, decoder(&InBuffer{}))
+	}
+	assert.Equal(t, RateLimitError, decoder(&InBuffer{}))
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, decoder(&InBuffer{}))
+}
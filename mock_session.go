@@ -92,9 +92,10 @@ func (session *MockSession) ReadPacket() (data []byte, err error) { // this is f
 	return
 }
 
-func (session *MockSession) AddCloseCallback(handler interface{}, callback func()) {
+func (session *MockSession) AddCloseCallback(callback func()) CloseCallbackHandle {
+	return 0
 }
-func (session *MockSession) RemoveCloseCallback(handler interface{}) {
+func (session *MockSession) RemoveCloseCallback(handle CloseCallbackHandle) {
 
 }
 func (session *MockSession) Process(decoder Decoder) error {
@@ -0,0 +1,577 @@
+package link
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors
+var (
+	MuxClosedError      = errors.New("Mux closed")
+	MuxFrameError       = errors.New("Bad mux frame")
+	StreamClosedError   = errors.New("Stream closed")
+	StreamResetError    = errors.New("Stream reset")
+	StreamRejectedError = errors.New("Stream rejected")
+)
+
+var (
+	DefaultStreamWindowSize = 256 * 1024 // Default receive window of each stream.
+	DefaultMuxFrameSize     = 16 * 1024  // Max data size of one frame, big writes are split to avoid blocking other streams.
+	DefaultMuxAcceptBacklog = 128        // Max streams waiting for Accept.
+	DefaultMuxControlQueue  = 1024       // Max control frames waiting for send, the mux closed when exceeded.
+)
+
+// {type:uint8}{stream id:uint32 little endian}{payload}
+const (
+	muxOpen   = 1 // payload is the receive window of opener, the accepter replies a window frame
+	muxData   = 2
+	muxWindow = 3 // payload is the window increment
+	muxFin    = 4
+	muxReset  = 5
+
+	muxHeadSize = 5
+)
+
+type muxFrame struct {
+	frameType uint8
+	streamId  uint32
+	data      []byte
+}
+
+func (frame muxFrame) Size() int {
+	return muxHeadSize + len(frame.data)
+}
+
+func (frame muxFrame) MarshalTo(buffer []byte) (n int, err error) {
+	if len(buffer) < frame.Size() {
+		return 0, BufferSizeNotEnough
+	}
+	buffer[0] = frame.frameType
+	binary.LittleEndian.PutUint32(buffer[1:], frame.streamId)
+	n = muxHeadSize + copy(buffer[muxHeadSize:], frame.data)
+	return
+}
+
+func uint32Frame(frameType uint8, streamId uint32, v uint32) muxFrame {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, v)
+	return muxFrame{frameType, streamId, data}
+}
+
+// The stream multiplexer. It provides many logical streams over one session,
+// each stream has independent flow control, so a slow stream don't block others.
+// The mux takes over the session reading, don't invoke Process on the session.
+type Mux struct {
+	session     SessionAble
+	mutex       sync.Mutex
+	streams     map[uint32]*Stream
+	nextId      uint32
+	parity      uint32 // the parity of the ids opened by this side
+	acceptChan  chan *Stream
+	controlChan chan muxFrame
+	closeChan   chan int
+	closeFlag   int32
+
+	windowSize int
+	frameSize  int
+}
+
+// Create a mux on a session. The two sides of the session must use different side.
+func NewMux(session SessionAble, side ProtocolSide) *Mux {
+	mux := &Mux{
+		session:     session,
+		streams:     make(map[uint32]*Stream),
+		acceptChan:  make(chan *Stream, DefaultMuxAcceptBacklog),
+		controlChan: make(chan muxFrame, DefaultMuxControlQueue),
+		closeChan:   make(chan int),
+		windowSize:  DefaultStreamWindowSize,
+		frameSize:   DefaultMuxFrameSize,
+	}
+	// client side streams are odd, server side streams are even
+	if side == CLIENT_SIDE {
+		mux.nextId = 1
+	} else {
+		mux.nextId = 2
+	}
+	mux.parity = mux.nextId % 2
+	session.AddCloseCallback(mux.close)
+	if session.IsClosed() {
+		mux.close()
+	}
+	go mux.controlLoop()
+	go session.Process(mux.decode)
+	return mux
+}
+
+// Get the session.
+func (mux *Mux) Session() SessionAble {
+	return mux.session
+}
+
+// Open a new stream.
+func (mux *Mux) Open() (*Stream, error) {
+	mux.mutex.Lock()
+	if mux.IsClosed() {
+		mux.mutex.Unlock()
+		return nil, MuxClosedError
+	}
+	// skip the ids still in use after wrapped around
+	for _, exists := mux.streams[mux.nextId]; exists; _, exists = mux.streams[mux.nextId] {
+		mux.nextId += 2
+	}
+	stream := newStream(mux, mux.nextId, 0)
+	mux.nextId += 2
+	mux.streams[stream.id] = stream
+	mux.mutex.Unlock()
+
+	if err := mux.send(uint32Frame(muxOpen, stream.id, uint32(mux.windowSize))); err != nil {
+		mux.remove(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept a stream opened by the remote side.
+func (mux *Mux) Accept() (*Stream, error) {
+	select {
+	case stream := <-mux.acceptChan:
+		return stream, nil
+	case <-mux.closeChan:
+		return nil, MuxClosedError
+	}
+}
+
+// How mush streams opened.
+func (mux *Mux) NumStreams() int {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+
+	return len(mux.streams)
+}
+
+// Check mux is closed or not.
+func (mux *Mux) IsClosed() bool {
+	return atomic.LoadInt32(&mux.closeFlag) != 0
+}
+
+// Close the mux and the session. All streams will closed.
+func (mux *Mux) Close() {
+	mux.session.Close()
+	mux.close()
+}
+
+func (mux *Mux) close() {
+	if atomic.CompareAndSwapInt32(&mux.closeFlag, 0, 1) {
+		mux.mutex.Lock()
+		streams := mux.streams
+		mux.streams = make(map[uint32]*Stream)
+		mux.mutex.Unlock()
+
+		close(mux.closeChan)
+		for _, stream := range streams {
+			stream.setReset(MuxClosedError)
+		}
+	}
+}
+
+func (mux *Mux) send(frame muxFrame) error {
+	if mux.IsClosed() {
+		return MuxClosedError
+	}
+	return mux.session.SendNow(frame)
+}
+
+// Send a control frame without blocking, used by the decoder.
+// The frames are sent in order by the control loop.
+func (mux *Mux) sendControl(frame muxFrame) {
+	if mux.IsClosed() {
+		return
+	}
+	select {
+	case mux.controlChan <- frame:
+	default:
+		// the remote side don't read
+		mux.Close()
+	}
+}
+
+func (mux *Mux) controlLoop() {
+	for {
+		select {
+		case frame := <-mux.controlChan:
+			if mux.send(frame) != nil {
+				mux.Close()
+				return
+			}
+		case <-mux.closeChan:
+			return
+		}
+	}
+}
+
+func (mux *Mux) get(id uint32) *Stream {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+
+	return mux.streams[id]
+}
+
+func (mux *Mux) remove(id uint32) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+
+	delete(mux.streams, id)
+}
+
+// Dispatch frames, invoked in the session reading goroutine.
+func (mux *Mux) decode(msg *InBuffer) error {
+	if len(msg.Data) < muxHeadSize {
+		return MuxFrameError
+	}
+	frameType := msg.Data[0]
+	id := binary.LittleEndian.Uint32(msg.Data[1:])
+	payload := msg.Data[muxHeadSize:]
+
+	if frameType == muxOpen {
+		if len(payload) < 4 {
+			return MuxFrameError
+		}
+		if id%2 == mux.parity {
+			// the id belongs to this side, the remote side can't open it
+			mux.sendControl(muxFrame{muxReset, id, nil})
+			return nil
+		}
+		stream := newStream(mux, id, int(binary.LittleEndian.Uint32(payload)))
+		mux.mutex.Lock()
+		_, exists := mux.streams[id]
+		closed := mux.IsClosed()
+		if !exists && !closed {
+			mux.streams[id] = stream
+		}
+		mux.mutex.Unlock()
+		if exists || closed {
+			return nil
+		}
+		select {
+		case mux.acceptChan <- stream:
+			// tell the opener our receive window
+			mux.sendControl(uint32Frame(muxWindow, id, uint32(mux.windowSize)))
+		default:
+			mux.remove(id)
+			mux.sendControl(muxFrame{muxReset, id, nil})
+		}
+		return nil
+	}
+
+	stream := mux.get(id)
+	if stream == nil {
+		if frameType != muxReset {
+			mux.sendControl(muxFrame{muxReset, id, nil})
+		}
+		return nil
+	}
+
+	switch frameType {
+	case muxData:
+		if !stream.receive(payload) && stream.setReset(StreamResetError) {
+			mux.remove(id)
+			mux.sendControl(muxFrame{muxReset, id, nil})
+		}
+	case muxWindow:
+		if len(payload) < 4 {
+			return MuxFrameError
+		}
+		stream.addSendWindow(int(binary.LittleEndian.Uint32(payload)))
+	case muxFin:
+		stream.setRemoteClosed()
+	case muxReset:
+		stream.setReset(StreamResetError)
+		mux.remove(id)
+	}
+	return nil
+}
+
+// The logical stream of a mux. It implements the net.Conn interface.
+type Stream struct {
+	id  uint32
+	mux *Mux
+
+	mutex         sync.Mutex
+	recvBuffer    bytes.Buffer
+	unacked       int // read but not acknowledged bytes
+	sendWindow    int
+	readClosed    bool
+	writeClosed   bool
+	remoteClosed  bool
+	resetError    error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readNotify    chan int
+	writeNotify   chan int
+}
+
+func newStream(mux *Mux, id uint32, sendWindow int) *Stream {
+	return &Stream{
+		id:          id,
+		mux:         mux,
+		sendWindow:  sendWindow,
+		readNotify:  make(chan int, 1),
+		writeNotify: make(chan int, 1),
+	}
+}
+
+// Get stream id.
+func (stream *Stream) Id() uint32 {
+	return stream.id
+}
+
+// Implement net.Conn interface.
+func (stream *Stream) Read(b []byte) (int, error) {
+	for {
+		stream.mutex.Lock()
+		if stream.recvBuffer.Len() > 0 {
+			n, _ := stream.recvBuffer.Read(b)
+			stream.unacked += n
+			var increment int
+			if stream.unacked >= stream.mux.windowSize/2 {
+				increment = stream.unacked
+				stream.unacked = 0
+			}
+			stream.mutex.Unlock()
+
+			if increment > 0 {
+				stream.mux.send(uint32Frame(muxWindow, stream.id, uint32(increment)))
+			}
+			return n, nil
+		}
+		err := stream.resetError
+		if err == nil && stream.readClosed {
+			err = StreamClosedError
+		}
+		if err == nil && stream.remoteClosed {
+			err = io.EOF
+		}
+		deadline := stream.readDeadline
+		stream.mutex.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		if err := stream.wait(stream.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Implement net.Conn interface. Blocks when the remote receive window is full.
+func (stream *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		stream.mutex.Lock()
+		err := stream.resetError
+		if err == nil && stream.writeClosed {
+			err = StreamClosedError
+		}
+		size := 0
+		if err == nil {
+			size = len(b) - written
+			if size > stream.sendWindow {
+				size = stream.sendWindow
+			}
+			if size > stream.mux.frameSize {
+				size = stream.mux.frameSize
+			}
+			stream.sendWindow -= size
+		}
+		deadline := stream.writeDeadline
+		stream.mutex.Unlock()
+
+		if err != nil {
+			return written, err
+		}
+		if size == 0 {
+			if err := stream.wait(stream.writeNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if err := stream.mux.send(muxFrame{muxData, stream.id, b[written : written+size]}); err != nil {
+			return written, err
+		}
+		written += size
+	}
+	return written, nil
+}
+
+func (stream *Stream) wait(notify chan int, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		duration := time.Until(deadline)
+		if duration <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func notify(c chan int) {
+	select {
+	case c <- 1:
+	default:
+	}
+}
+
+// Close the write side of the stream. The remote side will read io.EOF after the buffered data.
+func (stream *Stream) CloseWrite() error {
+	stream.mutex.Lock()
+	if stream.writeClosed || stream.resetError != nil {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.writeClosed = true
+	remoteClosed := stream.remoteClosed
+	stream.mutex.Unlock()
+
+	notify(stream.writeNotify)
+	if remoteClosed {
+		stream.mux.remove(stream.id)
+	}
+	return stream.mux.send(muxFrame{muxFin, stream.id, nil})
+}
+
+// Implement net.Conn interface. The stream can't read or write after closed,
+// the data still arriving will be discarded.
+func (stream *Stream) Close() error {
+	stream.mutex.Lock()
+	var increment int
+	if !stream.readClosed && stream.resetError == nil {
+		// acknowledge the discarded and unacknowledged data, so the remote writer don't stall
+		increment = stream.recvBuffer.Len() + stream.unacked
+		stream.unacked = 0
+	}
+	stream.readClosed = true
+	stream.recvBuffer.Reset()
+	stream.mutex.Unlock()
+
+	notify(stream.readNotify)
+	if increment > 0 {
+		stream.mux.send(uint32Frame(muxWindow, stream.id, uint32(increment)))
+	}
+	return stream.CloseWrite()
+}
+
+// Abort the stream, the remote side will get StreamResetError.
+func (stream *Stream) Reset() error {
+	if !stream.setReset(StreamResetError) {
+		return nil
+	}
+	stream.mux.remove(stream.id)
+	return stream.mux.send(muxFrame{muxReset, stream.id, nil})
+}
+
+// Returns false when the data exceed the receive window.
+func (stream *Stream) receive(data []byte) bool {
+	stream.mutex.Lock()
+	if stream.recvBuffer.Len()+stream.unacked+len(data) > stream.mux.windowSize {
+		stream.mutex.Unlock()
+		return false
+	}
+	discard := stream.readClosed || stream.resetError != nil
+	if !discard {
+		stream.recvBuffer.Write(data)
+	}
+	stream.mutex.Unlock()
+
+	if discard {
+		// nobody will read it, acknowledge at once so the remote writer don't stall
+		stream.mux.sendControl(uint32Frame(muxWindow, stream.id, uint32(len(data))))
+		return true
+	}
+	notify(stream.readNotify)
+	return true
+}
+
+func (stream *Stream) addSendWindow(increment int) {
+	stream.mutex.Lock()
+	stream.sendWindow += increment
+	stream.mutex.Unlock()
+
+	notify(stream.writeNotify)
+}
+
+func (stream *Stream) setRemoteClosed() {
+	stream.mutex.Lock()
+	stream.remoteClosed = true
+	writeClosed := stream.writeClosed
+	stream.mutex.Unlock()
+
+	notify(stream.readNotify)
+	if writeClosed {
+		stream.mux.remove(stream.id)
+	}
+}
+
+// Returns false when the stream is already reset.
+func (stream *Stream) setReset(err error) bool {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	if stream.resetError != nil {
+		return false
+	}
+	stream.resetError = err
+	notify(stream.readNotify)
+	notify(stream.writeNotify)
+	return true
+}
+
+// Implement net.Conn interface.
+func (stream *Stream) LocalAddr() net.Addr {
+	return stream.mux.session.Conn().LocalAddr()
+}
+
+// Implement net.Conn interface.
+func (stream *Stream) RemoteAddr() net.Addr {
+	return stream.mux.session.Conn().RemoteAddr()
+}
+
+// Implement net.Conn interface.
+func (stream *Stream) SetDeadline(t time.Time) error {
+	stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+// Implement net.Conn interface.
+func (stream *Stream) SetReadDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.readDeadline = t
+	stream.mutex.Unlock()
+
+	notify(stream.readNotify)
+	return nil
+}
+
+// Implement net.Conn interface.
+func (stream *Stream) SetWriteDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.writeDeadline = t
+	stream.mutex.Unlock()
+
+	notify(stream.writeNotify)
+	return nil
+}
@@ -0,0 +1,216 @@
+package link
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMuxPair(t *testing.T, handler func(stream *Stream)) (*Server, *Mux) {
+	server, err := Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go server.Serve(func(session SessionAble) {
+		mux := NewMux(session, SERVER_SIDE)
+		for {
+			stream, err := mux.Accept()
+			if err != nil {
+				return
+			}
+			go handler(stream)
+		}
+	})
+
+	session, err := Dial("tcp", server.Listener().Addr().String())
+	assert.Nil(t, err)
+	return server, NewMux(session, CLIENT_SIDE)
+}
+
+func echoStream(stream *Stream) {
+	io.Copy(stream, stream)
+	stream.Close()
+}
+
+func TestMuxEcho(t *testing.T) {
+	server, mux := newMuxPair(t, echoStream)
+	defer server.Stop()
+	defer mux.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := mux.Open()
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(1), stream.Id()%2)
+
+			data := make([]byte, 1024*1024)
+			rand.Read(data)
+			go func() {
+				stream.Write(data)
+				stream.CloseWrite()
+			}()
+			reply, err := io.ReadAll(stream)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(data, reply))
+		}()
+	}
+	wg.Wait()
+
+	waitUntil(t, func() bool {
+		return mux.NumStreams() == 0
+	})
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	blocked := make(chan *Stream, 1)
+	server, mux := newMuxPair(t, func(stream *Stream) {
+		var b [1]byte
+		stream.Read(b[:])
+		if b[0] == 'b' {
+			// never read the rest
+			blocked <- stream
+			return
+		}
+		echoStream(stream)
+	})
+	defer server.Stop()
+	defer mux.Close()
+
+	slow, err := mux.Open()
+	assert.Nil(t, err)
+	_, err = slow.Write([]byte{'b'})
+	assert.Nil(t, err)
+	remote := <-blocked
+
+	slow.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := slow.Write(make([]byte, DefaultStreamWindowSize*2))
+	assert.Equal(t, os.ErrDeadlineExceeded, err)
+	assert.Equal(t, DefaultStreamWindowSize-1, n)
+
+	// other streams are not blocked by the slow one
+	fast, err := mux.Open()
+	assert.Nil(t, err)
+	_, err = fast.Write([]byte("ahello"))
+	assert.Nil(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(fast, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(reply))
+
+	// reading unblocks the writer
+	go io.Copy(io.Discard, remote)
+	slow.SetWriteDeadline(time.Time{})
+	_, err = slow.Write(make([]byte, DefaultStreamWindowSize))
+	assert.Nil(t, err)
+}
+
+func TestMuxReset(t *testing.T) {
+	server, mux := newMuxPair(t, func(stream *Stream) {
+		stream.Reset()
+	})
+	defer server.Stop()
+
+	stream, err := mux.Open()
+	assert.Nil(t, err)
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = stream.Read(make([]byte, 1))
+	assert.Equal(t, StreamResetError, err)
+
+	stream, err = mux.Open()
+	assert.Nil(t, err)
+	mux.Close()
+	_, err = stream.Read(make([]byte, 1))
+	assert.Equal(t, MuxClosedError, err)
+	_, err = mux.Open()
+	assert.Equal(t, MuxClosedError, err)
+	_, err = mux.Accept()
+	assert.Equal(t, MuxClosedError, err)
+}
+
+func TestMuxCloseUnread(t *testing.T) {
+	server, mux := newMuxPair(t, func(stream *Stream) {
+		io.ReadFull(stream, make([]byte, 10))
+		time.Sleep(100 * time.Millisecond)
+		stream.Close()
+	})
+	defer server.Stop()
+	defer mux.Close()
+
+	// the unread data is acknowledged when closed, the writer don't block
+	stream, err := mux.Open()
+	assert.Nil(t, err)
+	stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	n, err := stream.Write(make([]byte, 4*DefaultStreamWindowSize))
+	assert.Nil(t, err)
+	assert.Equal(t, 4*DefaultStreamWindowSize, n)
+}
+
+func TestMuxOpenParity(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+	go func() {
+		for {
+			if _, err := client.ReadPacket(); err != nil {
+				return
+			}
+		}
+	}()
+	mux := NewMux(session, SERVER_SIDE)
+	defer mux.Close()
+
+	// the remote side opens an id of this side
+	mux.decode(&InBuffer{Data: marshalMuxFrame(uint32Frame(muxOpen, 2, 1024))})
+	assert.Equal(t, 0, len(mux.acceptChan))
+	assert.Equal(t, 0, mux.NumStreams())
+
+	// the ids still in use are skipped after wrapped around
+	stream1, err := mux.Open()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), stream1.Id())
+	mux.nextId = 2
+	stream2, err := mux.Open()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(4), stream2.Id())
+	assert.Equal(t, stream1, mux.get(2))
+	assert.Equal(t, stream2, mux.get(4))
+}
+
+func marshalMuxFrame(frame muxFrame) []byte {
+	data := make([]byte, frame.Size())
+	frame.MarshalTo(data)
+	return data
+}
+
+func TestMuxDecodeNonBlocking(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+	mux := NewMux(session, SERVER_SIDE)
+	defer mux.Close()
+
+	// the remote side don't read, the resets of unknown streams must not block the decoder
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			mux.decode(&InBuffer{Data: marshalMuxFrame(muxFrame{muxData, uint32(i), []byte("x")})})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("decoder blocked")
+	}
+
+	// no stream accepted after closed
+	mux.Close()
+	mux.decode(&InBuffer{Data: marshalMuxFrame(uint32Frame(muxOpen, 1, 1024))})
+	assert.Equal(t, 0, len(mux.acceptChan))
+	assert.Equal(t, 0, mux.NumStreams())
+}
@@ -99,6 +99,7 @@ type simpleProtocol struct {
 	bo                 binary.ByteOrder
 	encodeHead         func(message Message, msgSize int, out *OutBuffer)
 	decodeHead         func([]byte) int
+	maxHeadSize        uint64 // The max size the header can present.
 	maxPacketReadSize  int
 	maxPacketWriteSize int
 }
@@ -112,8 +113,9 @@ func (p *simpleProtocol) setMaxPacketSize(maxPacketReadSize, maxPacketWriteSize
 
 func newSimpleProtocol(n int, byteOrder binary.ByteOrder) *simpleProtocol {
 	protocol := &simpleProtocol{
-		n:  n,
-		bo: byteOrder,
+		n:           n,
+		bo:          byteOrder,
+		maxHeadSize: ^uint64(0) >> (64 - uint(n)*8),
 	}
 
 	switch n {
@@ -158,6 +160,9 @@ func (p *simpleProtocol) New(v interface{}, _ ProtocolSide) (ProtocolState, erro
 
 func (p *simpleProtocol) WriteToBuffer(buffer *OutBuffer, message Message) error {
 	msgSize := message.Size()
+	if uint64(msgSize) > p.maxHeadSize {
+		return PacketSizeOverflowError
+	}
 	buffer.Prepare(p.n + msgSize)
 	if p.maxPacketWriteSize > 0 && msgSize > p.maxPacketWriteSize {
 		return PacketTooLargeForWriteError
@@ -192,6 +197,7 @@ func (p *simpleProtocol) Read(reader io.Reader, buffer *InBuffer) error {
 	}
 	// body
 	if size == 0 {
+		buffer.Data = buffer.Data[:0]
 		return nil
 	}
 	buffer.Prepare(size)
@@ -208,3 +214,46 @@ func (p *simpleProtocol) EncodeAuth(buffer *OutBuffer, message Message, msgSize
 func (p *simpleProtocol) DecodeAuth(bytes []byte) int {
 	return p.decodeHead(bytes)
 }
+
+// The protocol without packet header. Used by datagram transports like UDP,
+// each datagram is one packet, so the reader must return a whole datagram on each Read.
+var DatagramProtocol Protocol = datagramProtocol{}
+
+// The max packet size datagramProtocol can read.
+const maxDatagramSize = 65536
+
+type datagramProtocol struct{}
+
+func (p datagramProtocol) New(v interface{}, _ ProtocolSide) (ProtocolState, error) {
+	return p, nil
+}
+
+func (p datagramProtocol) WriteToBuffer(buffer *OutBuffer, message Message) error {
+	buffer.Prepare(message.Size())
+	return buffer.WriteMessage(message)
+}
+
+func (p datagramProtocol) Write(writer io.Writer, outBuffer *OutBuffer) error {
+	if len(outBuffer.Data) == 0 || outBuffer.pos == 0 {
+		return nil
+	}
+	_, err := writer.Write(outBuffer.GetData())
+	return err
+}
+
+func (p datagramProtocol) Read(reader io.Reader, buffer *InBuffer) error {
+	buffer.Prepare(maxDatagramSize)
+	n, err := reader.Read(buffer.Data)
+	if err != nil {
+		return err
+	}
+	buffer.Data = buffer.Data[:n]
+	return nil
+}
+
+func (p datagramProtocol) EncodeAuth(buffer *OutBuffer, message Message, msgSize int) {
+}
+
+func (p datagramProtocol) DecodeAuth(bytes []byte) int {
+	return 0
+}
@@ -0,0 +1,180 @@
+package link
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Errors
+var (
+	MessageIdMissingError = errors.New("Message too short for message id")
+	UnknownMessageError   = errors.New("Unknown message id")
+)
+
+// The message handler of router. The read position of message is after the message id.
+type Handler func(session SessionAble, msg *InBuffer) error
+
+// Wrap a handler. The id is the message id handled by the handler.
+type HandlerMiddleware func(id uint64, next Handler) Handler
+
+// The panic recovered by middleware.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("Panic: %v\n%s", err.Value, err.Stack)
+}
+
+// Message router. It reads a message id header and dispatch the message to the handler of the id.
+type Router struct {
+	idSize    int
+	byteOrder ByteOrder
+
+	mutex          sync.RWMutex
+	handlers       map[uint64]Handler
+	chains         map[uint64]Handler // handlers wrapped by middlewares
+	defaultHandler Handler
+	middlewares    []HandlerMiddleware
+}
+
+// Create a router. The idSize means how many bytes of the message id header, must be 1、2、4 or 8.
+func NewRouter(idSize int, byteOrder ByteOrder) *Router {
+	switch idSize {
+	case 1, 2, 4, 8:
+	default:
+		panic("unsupported message id size")
+	}
+	return &Router{
+		idSize:    idSize,
+		byteOrder: byteOrder,
+		handlers:  make(map[uint64]Handler),
+		chains:    make(map[uint64]Handler),
+	}
+}
+
+// Register the handler of a message id. Register a id twice will panic.
+func (router *Router) Handle(id uint64, handler Handler) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	if _, exists := router.handlers[id]; exists {
+		panic(fmt.Sprintf("message id %d already registered", id))
+	}
+	router.handlers[id] = handler
+	router.chains[id] = router.chain(id, handler)
+}
+
+// Set the handler of unknown message ids. Without it the router returns UnknownMessageError.
+func (router *Router) HandleDefault(handler Handler) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	router.defaultHandler = handler
+}
+
+// Append middlewares. The first middleware is the outermost.
+func (router *Router) Use(middlewares ...HandlerMiddleware) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	router.middlewares = append(router.middlewares, middlewares...)
+	for id, handler := range router.handlers {
+		router.chains[id] = router.chain(id, handler)
+	}
+}
+
+func (router *Router) chain(id uint64, handler Handler) Handler {
+	for i := len(router.middlewares) - 1; i >= 0; i-- {
+		handler = router.middlewares[i](id, handler)
+	}
+	return handler
+}
+
+// Create a decoder of the session. Usage: session.Process(router.Decode(session)).
+func (router *Router) Decode(session SessionAble) Decoder {
+	return func(msg *InBuffer) error {
+		return router.Dispatch(session, msg)
+	}
+}
+
+// Read the message id and invoke the handler.
+func (router *Router) Dispatch(session SessionAble, msg *InBuffer) error {
+	if len(msg.Data)-msg.ReadPos < router.idSize {
+		return MessageIdMissingError
+	}
+	id := router.readId(msg.Data[msg.ReadPos:])
+	msg.ReadPos += router.idSize
+
+	router.mutex.RLock()
+	handler, exists := router.chains[id]
+	if !exists && router.defaultHandler != nil {
+		// unknown message is rare, build the chain on the fly
+		handler = router.chain(id, router.defaultHandler)
+	}
+	router.mutex.RUnlock()
+
+	if handler == nil {
+		return UnknownMessageError
+	}
+	return handler(session, msg)
+}
+
+func (router *Router) readId(data []byte) uint64 {
+	switch router.idSize {
+	case 1:
+		return uint64(data[0])
+	case 2:
+		return uint64(router.byteOrder.Uint16(data))
+	case 4:
+		return uint64(router.byteOrder.Uint32(data))
+	}
+	return router.byteOrder.Uint64(data)
+}
+
+// Recover the panic of handler, returns the panic as *PanicError.
+func RecoverHandler() HandlerMiddleware {
+	return func(id uint64, next Handler) Handler {
+		return func(session SessionAble, msg *InBuffer) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					err = &PanicError{v, debug.Stack()}
+				}
+			}()
+			return next(session, msg)
+		}
+	}
+}
+
+// Report the time cost of each message.
+func TimeHandler(observe func(id uint64, duration time.Duration, err error)) HandlerMiddleware {
+	return func(id uint64, next Handler) Handler {
+		return func(session SessionAble, msg *InBuffer) error {
+			startTime := time.Now()
+			err := next(session, msg)
+			observe(id, time.Since(startTime), err)
+			return err
+		}
+	}
+}
+
+// Log the failed messages. Log all messages when verbose is true.
+func LogHandler(logger *log.Logger, verbose bool) HandlerMiddleware {
+	return func(id uint64, next Handler) Handler {
+		return func(session SessionAble, msg *InBuffer) error {
+			startTime := time.Now()
+			err := next(session, msg)
+			if err != nil {
+				logger.Printf("session %d message %d failed: %v", session.Id(), id, err)
+			} else if verbose {
+				logger.Printf("session %d message %d handled in %v", session.Id(), id, time.Since(startTime))
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter(t *testing.T) {
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+
+	router := NewRouter(2, BigEndian)
+	var calls []string
+	router.Handle(1, func(session SessionAble, msg *InBuffer) error {
+		calls = append(calls, "hello "+string(msg.Data[msg.ReadPos:]))
+		return nil
+	})
+	router.Handle(0x0102, func(session SessionAble, msg *InBuffer) error {
+		panic("oops")
+	})
+	assert.Panics(t, func() {
+		router.Handle(1, nil)
+	})
+
+	// auth middleware, message 1 is allowed without login
+	notLogin := errors.New("Not login")
+	router.Use(RecoverHandler(), func(id uint64, next Handler) Handler {
+		return func(session SessionAble, msg *InBuffer) error {
+			if id != 1 && session.GetState() == nil {
+				return notLogin
+			}
+			return next(session, msg)
+		}
+	})
+	var timed []uint64
+	router.Use(TimeHandler(func(id uint64, duration time.Duration, err error) {
+		timed = append(timed, id)
+	}))
+
+	decode := router.Decode(session)
+	assert.Nil(t, decode(&InBuffer{Data: []byte{0, 1, 'a'}}))
+	assert.Equal(t, []string{"hello a"}, calls)
+
+	assert.Equal(t, notLogin, decode(&InBuffer{Data: []byte{1, 2}}))
+	session.SetState(true)
+	err := decode(&InBuffer{Data: []byte{1, 2}})
+	assert.IsType(t, &PanicError{}, err)
+	assert.Equal(t, "oops", err.(*PanicError).Value)
+
+	assert.Equal(t, UnknownMessageError, decode(&InBuffer{Data: []byte{0, 3}}))
+	assert.Equal(t, MessageIdMissingError, decode(&InBuffer{Data: []byte{0}}))
+
+	var unknown []byte
+	router.HandleDefault(func(session SessionAble, msg *InBuffer) error {
+		unknown = msg.Data[:msg.ReadPos]
+		return nil
+	})
+	assert.Nil(t, decode(&InBuffer{Data: []byte{0, 3}}))
+	assert.Equal(t, []byte{0, 3}, unknown)
+	// the panic skipped the inner timing middleware
+	assert.Equal(t, []uint64{1, 3}, timed)
+}
+
+func TestRouterLog(t *testing.T) {
+	session, client := newPipeSessions(t, 7)
+	defer client.Close()
+
+	var output bytes.Buffer
+	router := NewRouter(1, LittleEndian)
+	router.Use(LogHandler(log.New(&output, "", 0), false))
+	router.Handle(5, func(SessionAble, *InBuffer) error {
+		return errors.New("bad")
+	})
+	router.Handle(6, func(SessionAble, *InBuffer) error {
+		return nil
+	})
+
+	router.Dispatch(session, &InBuffer{Data: []byte{6}})
+	router.Dispatch(session, &InBuffer{Data: []byte{5}})
+	assert.Equal(t, 1, strings.Count(output.String(), "\n"))
+	assert.Contains(t, output.String(), "session 7 message 5 failed: bad")
+}
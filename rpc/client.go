@@ -1,96 +1,62 @@
 package rpc
 
 import (
-	"encoding/json"
 	"errors"
-	"github.com/funny/link"
-	"strings"
-	"sync"
-	"sync/atomic"
+
+	"github.com/0studio/link"
 )
 
+// The client side of a rpc connection. The services registered on the client
+// can be called by the server.
 type Client struct {
-	session *link.Session
-	seqNum  uint32
-	mutex   sync.Mutex
-	request map[uint32]*rpcRequestState
+	*Peer
 }
 
-type rpcRequestState struct {
-	Reply interface{}
-	C     chan error
+// Dial a server with JsonCodec.
+func Dial(network, address string) (*Client, error) {
+	return DialCodec(network, address, JsonCodec)
 }
 
-func Dial(network, address string) (*Client, error) {
+// Dial a server, the args and replies of the connection are encoded by the codec.
+func DialCodec(network, address string, codec Codec) (*Client, error) {
 	session, err := link.Dial(network, address)
 	if err != nil {
 		return nil, err
 	}
-	client := &Client{
-		session: session,
-		request: make(map[uint32]*rpcRequestState),
+	methodIds, err := handshake(session, codec)
+	if err != nil {
+		session.Close()
+		return nil, err
 	}
-	go session.Process(func(msg *link.InBuffer) error {
-		seqNum := msg.ReadUint32LE()
-
-		client.mutex.Lock()
-		state := client.request[seqNum]
-		delete(client.request, seqNum)
-		client.mutex.Unlock()
-
-		if err := msg.ReadString(int(msg.ReadUint32LE())); err != "" {
-			state.C <- errors.New(err)
-			return nil
-		}
+	services := newRegistry()
+	services.register("_rpc", &builtinService{services})
+	client := &Client{newPeer(session, codec, services, nil)}
+	client.methodIds = methodIds
+	go session.Process(client.decode)
+	return client, nil
+}
 
-		if err := json.NewDecoder(msg).Decode(state.Reply); err != nil {
-			state.C <- err
-			return nil
+// Send the codec name as the first message, the server replies with seq num 0
+// and the method table.
+func handshake(session *link.Session, codec Codec) (map[string]uint64, error) {
+	if err := session.SendNow(link.String(codec.Name())); err != nil {
+		return nil, err
+	}
+	var reply replyMessage
+	var table []byte
+	err := session.ProcessOnce(func(msg *link.InBuffer) error {
+		if err := reply.Unmarshal(msg.Data[msg.ReadPos:]); err != nil {
+			return err
 		}
-
-		state.C <- nil
+		// the reply refer to the buffer of session
+		table = append(table, reply.Reply...)
 		return nil
 	})
-	return client, nil
-}
-
-func (client *Client) Call(serviceMethod string, args, reply interface{}) error {
-	var (
-		names  = strings.Split(serviceMethod, ".")
-		seqNum = atomic.AddUint32(&client.seqNum, 1)
-		c      = make(chan error, 1)
-	)
-
-	client.mutex.Lock()
-	client.request[seqNum] = &rpcRequestState{
-		Reply: reply,
-		C:     c,
+	if err != nil {
+		return nil, err
 	}
-	client.mutex.Unlock()
-
-	client.session.AsyncSend(link.MessageFunc(func(buffer *link.OutBuffer) error {
-		buffer.WriteUvarint(uint64(len(names[0])))
-		buffer.WriteString(names[0])
-		buffer.WriteUvarint(uint64(len(names[1])))
-		buffer.WriteString(names[1])
-		buffer.WriteUint32LE(seqNum)
-		return json.NewEncoder(buffer).Encode(args)
-	}), 0)
-
-	return <-c
-}
-
-func (client *Client) Close() {
-	client.session.Close()
-}
-
-type rpcRequest struct {
-	SeqNum  uint32
-	Service string
-	Method  string
-	Args    interface{}
-}
-
-func (req *rpcRequest) RecommendBufferSize() int {
-	return 1024
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	return parseMethodTable(table)
 }
@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/0studio/link"
+)
+
+// Errors
+var (
+	UnknownCodecError     = errors.New("RPC unknown codec")
+	NotBinaryMessageError = errors.New("RPC binary codec need link.Message and BinaryUnmarshaler")
+)
+
+// The codec of args and replies. It is negotiated per connection by name.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// The unmarshal counterpart of link.Message. The gogo protobuf types implement it.
+type BinaryUnmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+var (
+	JsonCodec   Codec = jsonCodec{}
+	GobCodec    Codec = gobCodec{}
+	BinaryCodec Codec = binaryCodec{} // For the types implement link.Message and BinaryUnmarshaler.
+)
+
+var (
+	codecMutex sync.RWMutex
+	codecs     = map[string]Codec{
+		JsonCodec.Name():   JsonCodec,
+		GobCodec.Name():    GobCodec,
+		BinaryCodec.Name(): BinaryCodec,
+	}
+)
+
+// Register a codec, so the server can accept the clients use it.
+func RegisterCodec(codec Codec) {
+	codecMutex.Lock()
+	defer codecMutex.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+func getCodec(name string) Codec {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+
+	return codecs[name]
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(link.Message)
+	if !ok {
+		return nil, NotBinaryMessageError
+	}
+	data := make([]byte, message.Size())
+	n, err := message.MarshalTo(data)
+	return data[:n], err
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	unmarshaler, ok := v.(BinaryUnmarshaler)
+	if !ok {
+		return NotBinaryMessageError
+	}
+	return unmarshaler.Unmarshal(data)
+}
@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/0studio/link"
+)
+
+// Errors
+var (
+	ArgumentTypeError = errors.New("RPC interceptor passed an argument of wrong type")
+)
+
+// The unary call seen by the interceptors.
+type CallInfo struct {
+	ServiceMethod string           // The name of the service and method.
+	Session       link.SessionAble // The session of the connection.
+	Notify        bool             // The call has no reply.
+}
+
+// Invoke the method on the server side, or send the call and wait the reply on the client side.
+// The args and reply are the decoded values on the server side, the reply is nil for notifications.
+type Invoker func(ctx context.Context, info *CallInfo, args, reply interface{}) error
+
+// Wrap the unary calls. The interceptor can return an error without invoking next.
+// The streaming calls are not intercepted.
+type Interceptor func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error
+
+// The first interceptor is the outermost.
+func chainInterceptors(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, info *CallInfo, args, reply interface{}) error {
+			return interceptor(ctx, info, args, reply, next)
+		}
+	}
+	return invoker
+}
+
+// Append the interceptors of the calls to the remote side. The first interceptor is the outermost.
+func (peer *Peer) UseClient(interceptors ...Interceptor) {
+	peer.interceptorMutex.Lock()
+	defer peer.interceptorMutex.Unlock()
+
+	// copy on write, so the calls in progress are not affected
+	peer.clientInterceptors = append(peer.clientInterceptors[:len(peer.clientInterceptors):len(peer.clientInterceptors)], interceptors...)
+}
+
+// Append the interceptors of the calls from the remote side. On the server side
+// they run inside the interceptors of Server.
+func (peer *Peer) UseServer(interceptors ...Interceptor) {
+	peer.interceptorMutex.Lock()
+	defer peer.interceptorMutex.Unlock()
+
+	peer.serverInterceptors = append(peer.serverInterceptors[:len(peer.serverInterceptors):len(peer.serverInterceptors)], interceptors...)
+}
+
+func (peer *Peer) getInterceptors() (client, server []Interceptor) {
+	peer.interceptorMutex.RLock()
+	defer peer.interceptorMutex.RUnlock()
+
+	return peer.clientInterceptors, peer.serverInterceptors
+}
+
+// Invoke the method of a call from the remote side.
+func (peer *Peer) invoke(ctx context.Context, m *rpcMethod, notify bool, argv, replyv reflect.Value) error {
+	_, interceptors := peer.getInterceptors()
+	if len(interceptors) == 0 || m.Streaming != streamNone {
+		return m.call(ctx, argv, replyv)
+	}
+	info := &CallInfo{
+		ServiceMethod: m.Service.Name + "." + m.Name,
+		Session:       peer.session,
+		Notify:        notify,
+	}
+	var reply interface{}
+	if !notify {
+		reply = replyv.Interface()
+	}
+	return chainInterceptors(interceptors, func(ctx context.Context, info *CallInfo, args, _ interface{}) error {
+		// the interceptors may replace the args
+		if args == nil || reflect.TypeOf(args) != m.ArgsType {
+			return ArgumentTypeError
+		}
+		return m.call(ctx, reflect.ValueOf(args), replyv)
+	})(ctx, info, argv.Interface(), reply)
+}
+
+// Report the time cost of each call.
+func TimeInterceptor(observe func(serviceMethod string, duration time.Duration, err error)) Interceptor {
+	return func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error {
+		startTime := time.Now()
+		err := next(ctx, info, args, reply)
+		observe(info.ServiceMethod, time.Since(startTime), err)
+		return err
+	}
+}
+
+// Log the failed calls. Log all calls when verbose is true.
+func LogInterceptor(logger *log.Logger, verbose bool) Interceptor {
+	return func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error {
+		startTime := time.Now()
+		err := next(ctx, info, args, reply)
+		if err != nil {
+			logger.Printf("session %d call %s failed: %v", info.Session.Id(), info.ServiceMethod, err)
+		} else if verbose {
+			logger.Printf("session %d call %s done in %v", info.Session.Id(), info.ServiceMethod, time.Since(startTime))
+		}
+		return err
+	}
+}
@@ -0,0 +1,297 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/0studio/link"
+)
+
+// Errors
+var (
+	BadMessageError = errors.New("RPC bad message")
+)
+
+// Each message begins with a kind byte, except the codec name handshake.
+// The requests and notifications can be sent by both sides of a connection.
+const (
+	kindRequest      = 1
+	kindReply        = 2
+	kindCancel       = 3
+	kindNotification = 4
+	kindStream       = 5
+)
+
+// The frames of streaming calls. The end of streaming call is the reply message.
+const (
+	streamData   = 1 // An item of the stream.
+	streamWindow = 2 // The receiver consumed items, {count:uvarint}.
+	streamEnd    = 3 // The caller has no more args.
+
+	streamFromCaller = 0x80 // The frame is sent by the caller side.
+)
+
+// {kind}{method id:uvarint}[{service len:uvarint}{service}{method len:uvarint}{method}]{seq num:uint32 LE}{timeout ms:uvarint}{metadata}{args}
+// The service and method names present only when the method id is 0.
+// The timeout is 0 when the call has no deadline.
+// A notification is {kind}{method id:uvarint}[{service}{method}]{metadata}{args}, it has no reply.
+type requestMessage struct {
+	MethodId uint64
+	Service  string
+	Method   string
+	SeqNum   uint32
+	Timeout  uint64
+	Metadata Metadata
+	Args     []byte
+	Notify   bool
+}
+
+func (msg *requestMessage) Size() int {
+	size := 1 + uvarintSize(msg.MethodId) + metadataSize(msg.Metadata) + len(msg.Args)
+	if !msg.Notify {
+		size += 4 + uvarintSize(msg.Timeout)
+	}
+	if msg.MethodId == 0 {
+		size += uvarintSize(uint64(len(msg.Service))) + len(msg.Service) +
+			uvarintSize(uint64(len(msg.Method))) + len(msg.Method)
+	}
+	return size
+}
+
+func (msg *requestMessage) MarshalTo(buffer []byte) (n int, err error) {
+	if len(buffer) < msg.Size() {
+		return 0, link.BufferSizeNotEnough
+	}
+	buffer[0] = kindRequest
+	if msg.Notify {
+		buffer[0] = kindNotification
+	}
+	n = 1 + binary.PutUvarint(buffer[1:], msg.MethodId)
+	if msg.MethodId == 0 {
+		n += putString(buffer[n:], msg.Service)
+		n += putString(buffer[n:], msg.Method)
+	}
+	if !msg.Notify {
+		binary.LittleEndian.PutUint32(buffer[n:], msg.SeqNum)
+		n += 4
+		n += binary.PutUvarint(buffer[n:], msg.Timeout)
+	}
+	n += putMetadata(buffer[n:], msg.Metadata)
+	n += copy(buffer[n:], msg.Args)
+	return
+}
+
+// The args refer to the data of msg, the metadata is copied.
+func (msg *requestMessage) Unmarshal(data []byte) error {
+	if len(data) < 1 || (data[0] != kindRequest && data[0] != kindNotification) {
+		return BadMessageError
+	}
+	msg.Notify = data[0] == kindNotification
+	methodId, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return BadMessageError
+	}
+	msg.MethodId = methodId
+	data = data[1+n:]
+
+	msg.Service, msg.Method = "", ""
+	if msg.MethodId == 0 {
+		var ok bool
+		if msg.Service, data, ok = getString(data); !ok {
+			return BadMessageError
+		}
+		if msg.Method, data, ok = getString(data); !ok {
+			return BadMessageError
+		}
+	}
+	msg.SeqNum, msg.Timeout = 0, 0
+	if !msg.Notify {
+		if len(data) < 4 {
+			return BadMessageError
+		}
+		msg.SeqNum = binary.LittleEndian.Uint32(data)
+		timeout, n := binary.Uvarint(data[4:])
+		if n <= 0 {
+			return BadMessageError
+		}
+		msg.Timeout = timeout
+		data = data[4+n:]
+	}
+	var ok bool
+	if msg.Metadata, data, ok = getMetadata(data); !ok {
+		return BadMessageError
+	}
+	msg.Args = data
+	return nil
+}
+
+// {kind}{seq num:uint32 LE}{error len:uint32 LE}{error}{metadata}{reply}
+type replyMessage struct {
+	SeqNum   uint32
+	Error    string
+	Metadata Metadata
+	Reply    []byte
+}
+
+func (msg *replyMessage) Size() int {
+	return 9 + len(msg.Error) + metadataSize(msg.Metadata) + len(msg.Reply)
+}
+
+func (msg *replyMessage) MarshalTo(buffer []byte) (n int, err error) {
+	if len(buffer) < msg.Size() {
+		return 0, link.BufferSizeNotEnough
+	}
+	buffer[0] = kindReply
+	binary.LittleEndian.PutUint32(buffer[1:], msg.SeqNum)
+	binary.LittleEndian.PutUint32(buffer[5:], uint32(len(msg.Error)))
+	n = 9 + copy(buffer[9:], msg.Error)
+	n += putMetadata(buffer[n:], msg.Metadata)
+	n += copy(buffer[n:], msg.Reply)
+	return
+}
+
+// The reply refer to the data of msg, the metadata is copied.
+func (msg *replyMessage) Unmarshal(data []byte) error {
+	if len(data) < 9 || data[0] != kindReply {
+		return BadMessageError
+	}
+	msg.SeqNum = binary.LittleEndian.Uint32(data[1:])
+	size := binary.LittleEndian.Uint32(data[5:])
+	if uint64(len(data)-9) < uint64(size) {
+		return BadMessageError
+	}
+	msg.Error = string(data[9 : 9+size])
+	var ok bool
+	if msg.Metadata, data, ok = getMetadata(data[9+size:]); !ok {
+		return BadMessageError
+	}
+	msg.Reply = data
+	return nil
+}
+
+// {kind}{seq num:uint32 LE}{frame:uint8}{data}
+// The high bit of frame means it's sent by the caller, because both sides can call.
+type streamMessage struct {
+	SeqNum uint32
+	Caller bool
+	Frame  byte
+	Data   []byte
+}
+
+func (msg *streamMessage) Size() int {
+	return 6 + len(msg.Data)
+}
+
+func (msg *streamMessage) MarshalTo(buffer []byte) (n int, err error) {
+	if len(buffer) < msg.Size() {
+		return 0, link.BufferSizeNotEnough
+	}
+	buffer[0] = kindStream
+	binary.LittleEndian.PutUint32(buffer[1:], msg.SeqNum)
+	buffer[5] = msg.Frame
+	if msg.Caller {
+		buffer[5] |= streamFromCaller
+	}
+	return 6 + copy(buffer[6:], msg.Data), nil
+}
+
+// The data refer to the data of msg.
+func (msg *streamMessage) Unmarshal(data []byte) error {
+	if len(data) < 6 || data[0] != kindStream {
+		return BadMessageError
+	}
+	msg.SeqNum = binary.LittleEndian.Uint32(data[1:])
+	msg.Caller = data[5]&streamFromCaller != 0
+	msg.Frame = data[5] &^ streamFromCaller
+	msg.Data = data[6:]
+	return nil
+}
+
+// {kind}{seq num:uint32 LE}
+// The caller gave up the call, the remote side cancel the context of the call.
+type cancelMessage struct {
+	SeqNum uint32
+}
+
+func (msg *cancelMessage) Size() int {
+	return 5
+}
+
+func (msg *cancelMessage) MarshalTo(buffer []byte) (n int, err error) {
+	if len(buffer) < msg.Size() {
+		return 0, link.BufferSizeNotEnough
+	}
+	buffer[0] = kindCancel
+	binary.LittleEndian.PutUint32(buffer[1:], msg.SeqNum)
+	return 5, nil
+}
+
+func (msg *cancelMessage) Unmarshal(data []byte) error {
+	if len(data) < 5 || data[0] != kindCancel {
+		return BadMessageError
+	}
+	msg.SeqNum = binary.LittleEndian.Uint32(data[1:])
+	return nil
+}
+
+func uvarintSize(v uint64) int {
+	var buffer [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buffer[:], v)
+}
+
+func putString(buffer []byte, s string) int {
+	n := binary.PutUvarint(buffer, uint64(len(s)))
+	return n + copy(buffer[n:], s)
+}
+
+func getString(data []byte) (string, []byte, bool) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return "", nil, false
+	}
+	return string(data[n : n+int(size)]), data[n+int(size):], true
+}
+
+// {count:uvarint}{key len:uvarint}{key}{value len:uvarint}{value}...
+func metadataSize(md Metadata) int {
+	size := uvarintSize(uint64(len(md)))
+	for key, value := range md {
+		size += uvarintSize(uint64(len(key))) + len(key) + uvarintSize(uint64(len(value))) + len(value)
+	}
+	return size
+}
+
+func putMetadata(buffer []byte, md Metadata) int {
+	n := binary.PutUvarint(buffer, uint64(len(md)))
+	for key, value := range md {
+		n += putString(buffer[n:], key)
+		n += binary.PutUvarint(buffer[n:], uint64(len(value)))
+		n += copy(buffer[n:], value)
+	}
+	return n
+}
+
+// Returns nil metadata when the count is 0. The values are copied.
+func getMetadata(data []byte) (Metadata, []byte, bool) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return nil, nil, false
+	}
+	data = data[n:]
+	if count == 0 {
+		return nil, data, true
+	}
+	md := make(Metadata, count)
+	for i := uint64(0); i < count; i++ {
+		var key, value string
+		var ok bool
+		if key, data, ok = getString(data); !ok {
+			return nil, nil, false
+		}
+		if value, data, ok = getString(data); !ok {
+			return nil, nil, false
+		}
+		md[key] = []byte(value)
+	}
+	return md, data, true
+}
@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+)
+
+// The metadata of requests and replies, such as trace ids, user identity and versions.
+type Metadata map[string][]byte
+
+// Returns a copy of md merged with others, the later values overwrite the earlier.
+func (md Metadata) Merge(others ...Metadata) Metadata {
+	size := len(md)
+	for _, other := range others {
+		size += len(other)
+	}
+	merged := make(Metadata, size)
+	for key, value := range md {
+		merged[key] = value
+	}
+	for _, other := range others {
+		for key, value := range other {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+type metadataKey int
+
+const (
+	outgoingMetadataKey metadataKey = iota
+	incomingMetadataKey
+	replyMetadataKey
+	replyCaptureKey
+)
+
+// Returns a context, the calls with it send the metadata. It merges the metadata set before.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	if outgoing, ok := ctx.Value(outgoingMetadataKey).(Metadata); ok {
+		md = outgoing.Merge(md)
+	}
+	return context.WithValue(ctx, outgoingMetadataKey, md)
+}
+
+func outgoingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingMetadataKey).(Metadata)
+	return md
+}
+
+// The metadata of the request, the ctx is the context of a method or an interceptor.
+// Don't modify the returned metadata.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingMetadataKey).(Metadata)
+	return md
+}
+
+// The metadata sent with the reply of a call.
+type replyMetadata struct {
+	mutex sync.Mutex
+	md    Metadata
+}
+
+func withIncomingMetadata(ctx context.Context, md Metadata, notify bool) context.Context {
+	if md != nil {
+		ctx = context.WithValue(ctx, incomingMetadataKey, md)
+	}
+	if !notify {
+		ctx = context.WithValue(ctx, replyMetadataKey, &replyMetadata{})
+	}
+	return ctx
+}
+
+// Set a value of the reply metadata, the ctx is the context of a method or an interceptor.
+// It does nothing for notifications.
+func SetReplyMetadata(ctx context.Context, key string, value []byte) {
+	if reply, ok := ctx.Value(replyMetadataKey).(*replyMetadata); ok {
+		reply.mutex.Lock()
+		defer reply.mutex.Unlock()
+
+		if reply.md == nil {
+			reply.md = make(Metadata)
+		}
+		reply.md[key] = value
+	}
+}
+
+func getReplyMetadata(ctx context.Context) Metadata {
+	if reply, ok := ctx.Value(replyMetadataKey).(*replyMetadata); ok {
+		reply.mutex.Lock()
+		defer reply.mutex.Unlock()
+
+		return reply.md
+	}
+	return nil
+}
+
+// Returns a context, the metadata of the reply is copied into md when the call done.
+func WithReplyMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, replyCaptureKey, md)
+}
+
+func replyCapture(ctx context.Context) Metadata {
+	md, _ := ctx.Value(replyCaptureKey).(Metadata)
+	return md
+}
@@ -0,0 +1,624 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0studio/link"
+)
+
+// Errors
+var (
+	ConnectionLostError = errors.New("RPC connection lost")
+	ServerBusyError     = errors.New("RPC server busy")
+)
+
+// One side of a rpc connection. Both sides can register services and call the
+// services of the other side over the same session, so the server can call the clients.
+type Peer struct {
+	session   link.SessionAble
+	codec     Codec
+	services  *registry         // the services of this side
+	parent    *registry         // the services of the server, nil on the client side
+	methodIds map[string]uint64 // the method table of the server, nil on the server side
+
+	// the calls to the remote side
+	mutex   sync.Mutex
+	seqNum  uint32
+	request map[uint32]*Call
+	closed  bool
+
+	// the calls from the remote side
+	callMutex   sync.Mutex
+	calls       map[uint32]context.CancelFunc
+	streams     map[uint32]*Stream // the streams of streaming calls
+	slots       chan struct{}      // limit the concurrent calls of connection
+	serverSlots chan struct{}      // limit the concurrent calls of server
+
+	interceptorMutex   sync.RWMutex
+	clientInterceptors []Interceptor
+	serverInterceptors []Interceptor
+}
+
+// An active RPC call, like the net/rpc.Call.
+type Call struct {
+	ServiceMethod string      // The name of the service and method to call.
+	Args          interface{} // The argument to the function (*struct).
+	Reply         interface{} // The reply from the function (*struct).
+	Error         error       // After completion, the error status.
+	Done          chan *Call  // Strobes when call is complete.
+
+	seqNum        uint32
+	stream        *Stream  // the caller side of a streaming call
+	metadata      Metadata // the metadata of request
+	replyMetadata Metadata // the metadata of reply is copied into it
+}
+
+func (call *Call) done() {
+	select {
+	case call.Done <- call:
+	default:
+		// the done channel has not enough buffer, don't block the client
+	}
+}
+
+func newPeer(session link.SessionAble, codec Codec, services, parent *registry) *Peer {
+	peer := &Peer{
+		session:  session,
+		codec:    codec,
+		services: services,
+		parent:   parent,
+		request:  make(map[uint32]*Call),
+		calls:    make(map[uint32]context.CancelFunc),
+		streams:  make(map[uint32]*Stream),
+	}
+	session.AddCloseCallback(peer.closeCallback)
+	if session.IsClosed() {
+		peer.closeCallback()
+	}
+	return peer
+}
+
+// The session of the connection.
+func (peer *Peer) Session() link.SessionAble {
+	return peer.session
+}
+
+// Register the exported methods of the receiver, so the remote side can call them.
+// On the server side the services only belong to this connection.
+func (peer *Peer) Register(service interface{}) error {
+	return peer.services.register("", service)
+}
+
+// Register the exported methods of the receiver with the service name.
+func (peer *Peer) RegisterName(name string, service interface{}) error {
+	return peer.services.register(name, service)
+}
+
+// Invoke the function synchronously.
+func (peer *Peer) Call(serviceMethod string, args, reply interface{}) error {
+	call := <-peer.Go(serviceMethod, args, reply, make(chan *Call, 1)).Done
+	return call.Error
+}
+
+// Invoke the function synchronously. The deadline of context is sent to the remote side,
+// and the remote side cancel the call when the context canceled.
+func (peer *Peer) CallContext(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	interceptors, _ := peer.getInterceptors()
+	if len(interceptors) == 0 {
+		return peer.callContext(ctx, serviceMethod, args, reply)
+	}
+	return chainInterceptors(interceptors, peer.clientInvoker)(ctx, &CallInfo{
+		ServiceMethod: serviceMethod,
+		Session:       peer.session,
+	}, args, reply)
+}
+
+func (peer *Peer) clientInvoker(ctx context.Context, info *CallInfo, args, reply interface{}) error {
+	if info.Notify {
+		return peer.notify(ctx, info.ServiceMethod, args)
+	}
+	return peer.callContext(ctx, info.ServiceMethod, args, reply)
+}
+
+func (peer *Peer) callContext(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	timeout, err := contextTimeout(ctx)
+	if err != nil {
+		return err
+	}
+
+	call := peer.send(&Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+		metadata:      outgoingMetadata(ctx),
+		replyMetadata: replyCapture(ctx),
+	}, timeout)
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		if peer.remove(call.seqNum) == nil {
+			// replied before canceled
+			<-call.Done
+			return call.Error
+		}
+		if ctx.Err() == context.Canceled {
+			// the remote side cancel the call itself when deadline exceeded
+			peer.session.SendNow(&cancelMessage{call.seqNum})
+		}
+		return ctx.Err()
+	}
+}
+
+// Invoke the function asynchronously. It returns the Call structure representing the invocation.
+// The done channel will signal when the call is complete by returning the same Call object.
+// If done is nil, Go will allocate a new channel. If non-nil, done must be buffered or Go will panic.
+func (peer *Peer) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 1)
+	} else if cap(done) == 0 {
+		panic("rpc: done channel is unbuffered")
+	}
+	if interceptors, _ := peer.getInterceptors(); len(interceptors) != 0 {
+		// the interceptors see the whole call, include waiting the reply
+		call := &Call{
+			ServiceMethod: serviceMethod,
+			Args:          args,
+			Reply:         reply,
+			Done:          done,
+		}
+		go func() {
+			call.Error = peer.CallContext(context.Background(), serviceMethod, args, reply)
+			call.done()
+		}()
+		return call
+	}
+	return peer.send(&Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          done,
+	}, 0)
+}
+
+// The timeout sent to the remote side, 0 means no deadline.
+func contextTimeout(ctx context.Context) (time.Duration, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return timeout, nil
+}
+
+// Invoke the function without reply. It returns when the notification sent,
+// the errors of the remote side are dropped.
+func (peer *Peer) Notify(serviceMethod string, args interface{}) error {
+	return peer.NotifyContext(context.Background(), serviceMethod, args)
+}
+
+// Invoke the function without reply, the metadata of context is sent.
+func (peer *Peer) NotifyContext(ctx context.Context, serviceMethod string, args interface{}) error {
+	interceptors, _ := peer.getInterceptors()
+	if len(interceptors) == 0 {
+		return peer.notify(ctx, serviceMethod, args)
+	}
+	return chainInterceptors(interceptors, peer.clientInvoker)(ctx, &CallInfo{
+		ServiceMethod: serviceMethod,
+		Session:       peer.session,
+		Notify:        true,
+	}, args, nil)
+}
+
+func (peer *Peer) notify(ctx context.Context, serviceMethod string, args interface{}) error {
+	request, err := peer.newRequest(serviceMethod, args)
+	if err != nil {
+		return err
+	}
+	request.Notify = true
+	request.Metadata = outgoingMetadata(ctx)
+	return peer.session.SendNow(request)
+}
+
+func (peer *Peer) newRequest(serviceMethod string, args interface{}) (*requestMessage, error) {
+	names := strings.SplitN(serviceMethod, ".", 2)
+	if len(names) != 2 {
+		return nil, errors.New("RPC service/method request ill-formed: " + serviceMethod)
+	}
+
+	request := &requestMessage{
+		MethodId: peer.methodIds[serviceMethod],
+	}
+	if args != nil {
+		// the client streaming calls have no args
+		data, err := peer.codec.Marshal(args)
+		if err != nil {
+			return nil, err
+		}
+		request.Args = data
+	}
+	if request.MethodId == 0 {
+		// the method registered after connected, not exists, or the remote side is a client
+		request.Service, request.Method = names[0], names[1]
+	}
+	return request, nil
+}
+
+func (peer *Peer) send(call *Call, timeout time.Duration) *Call {
+	request, err := peer.newRequest(call.ServiceMethod, call.Args)
+	if err != nil {
+		call.Error = err
+		call.done()
+		return call
+	}
+
+	peer.mutex.Lock()
+	if peer.closed {
+		peer.mutex.Unlock()
+		call.Error = ConnectionLostError
+		call.done()
+		return call
+	}
+	peer.seqNum++
+	if peer.seqNum == 0 {
+		// 0 is the handshake
+		peer.seqNum++
+	}
+	call.seqNum = peer.seqNum
+	if call.stream != nil {
+		call.stream.seqNum = call.seqNum
+	}
+	peer.request[call.seqNum] = call
+	peer.mutex.Unlock()
+
+	request.SeqNum = call.seqNum
+	request.Metadata = call.metadata
+	request.Timeout = uint64((timeout + time.Millisecond - 1) / time.Millisecond)
+	if err := peer.session.SendNow(request); err != nil && peer.remove(call.seqNum) != nil {
+		call.Error = err
+		call.done()
+	}
+	return call
+}
+
+// Remove a pending call. Returns nil when the call is not pending.
+func (peer *Peer) remove(seqNum uint32) *Call {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	call := peer.request[seqNum]
+	delete(peer.request, seqNum)
+	return call
+}
+
+// Fail the pending calls and cancel the calls from the remote side when the session closed.
+func (peer *Peer) closeCallback() {
+	peer.mutex.Lock()
+	peer.closed = true
+	request := peer.request
+	peer.request = make(map[uint32]*Call)
+	peer.mutex.Unlock()
+
+	for _, call := range request {
+		if call.stream != nil {
+			call.stream.finish(ConnectionLostError, nil)
+			continue
+		}
+		call.Error = ConnectionLostError
+		call.done()
+	}
+
+	peer.callMutex.Lock()
+	defer peer.callMutex.Unlock()
+
+	for _, cancel := range peer.calls {
+		cancel()
+	}
+}
+
+func (peer *Peer) Close() {
+	peer.session.Close()
+}
+
+func (peer *Peer) decode(msg *link.InBuffer) error {
+	data := msg.Data[msg.ReadPos:]
+	if len(data) == 0 {
+		return BadMessageError
+	}
+	switch data[0] {
+	case kindReply:
+		return peer.decodeReply(data)
+	case kindStream:
+		return peer.decodeStream(data)
+	case kindCancel:
+		var cancel cancelMessage
+		if err := cancel.Unmarshal(data); err != nil {
+			return err
+		}
+		peer.callMutex.Lock()
+		if cancelFunc := peer.calls[cancel.SeqNum]; cancelFunc != nil {
+			cancelFunc()
+		}
+		peer.callMutex.Unlock()
+		return nil
+	}
+	return peer.decodeRequest(data)
+}
+
+func (peer *Peer) decodeReply(data []byte) error {
+	var reply replyMessage
+	if err := reply.Unmarshal(data); err != nil {
+		return err
+	}
+
+	call := peer.remove(reply.SeqNum)
+	if call == nil {
+		// the call is canceled
+		return nil
+	}
+	if call.replyMetadata != nil {
+		for key, value := range reply.Metadata {
+			call.replyMetadata[key] = value
+		}
+	}
+
+	if call.stream != nil {
+		// the end of streaming call
+		if reply.Error != "" {
+			call.stream.finish(errors.New(reply.Error), nil)
+		} else {
+			call.stream.finish(io.EOF, append([]byte(nil), reply.Reply...))
+		}
+		return nil
+	}
+
+	if reply.Error != "" {
+		call.Error = errors.New(reply.Error)
+	} else {
+		call.Error = peer.codec.Unmarshal(reply.Reply, call.Reply)
+	}
+	call.done()
+	return nil
+}
+
+func (peer *Peer) getMethod(request *requestMessage) *rpcMethod {
+	if request.MethodId != 0 {
+		// the method ids are assigned by the server
+		if peer.parent != nil {
+			return peer.parent.getMethodById(request.MethodId)
+		}
+		return peer.services.getMethodById(request.MethodId)
+	}
+	if m := peer.services.getMethod(request.Service, request.Method); m != nil || peer.parent == nil {
+		return m
+	}
+	return peer.parent.getMethod(request.Service, request.Method)
+}
+
+func (peer *Peer) decodeRequest(data []byte) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Println("RPC error:", e)
+			err = errors.New("RPC failed")
+		}
+	}()
+
+	var request requestMessage
+	if err := request.Unmarshal(data); err != nil {
+		return err
+	}
+	m := peer.getMethod(&request)
+	if m == nil {
+		var reply = &replyMessage{SeqNum: request.SeqNum}
+		if request.MethodId != 0 {
+			reply.Error = "RPC method id not exists: " + strconv.FormatUint(request.MethodId, 10)
+		} else {
+			reply.Error = "RPC service not exists: " + request.Service + "." + request.Method
+		}
+		if request.Notify {
+			log.Println(reply.Error)
+			return nil
+		}
+		return peer.session.SendNow(reply)
+	}
+	if request.Notify && m.Streaming != streamNone {
+		log.Println("RPC streaming method can't be notified:", m.Service.Name+"."+m.Name)
+		return nil
+	}
+
+	// don't wait the slot, the connection keep reading the replies and cancels
+	if !tryAcquireSlot(peer.slots) {
+		if request.Notify {
+			log.Println("RPC notification", m.Service.Name+"."+m.Name, "dropped:", ServerBusyError)
+			return nil
+		}
+		return peer.session.SendNow(&replyMessage{SeqNum: request.SeqNum, Error: ServerBusyError.Error()})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if request.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(request.Timeout)*time.Millisecond)
+	}
+	ctx = withIncomingMetadata(ctx, request.Metadata, request.Notify)
+
+	var stream *Stream
+	if m.Streaming != streamNone {
+		stream = newStream(ctx, peer, false)
+		stream.seqNum = request.SeqNum
+	}
+
+	var argv reflect.Value
+	argIsValue := false
+	if m.Streaming == streamArgs {
+		argv = reflect.ValueOf(stream)
+	} else if m.ArgsType.Kind() == reflect.Ptr {
+		argv = reflect.New(m.ArgsType.Elem())
+	} else {
+		argv = reflect.New(m.ArgsType)
+		argIsValue = true
+	}
+	if m.Streaming != streamArgs {
+		if err := peer.codec.Unmarshal(request.Args, argv.Interface()); err != nil {
+			cancel()
+			releaseSlot(peer.slots)
+			// only this call failed, the connection is still usable
+			errMsg := "RPC decode request argument failed: " + err.Error()
+			if request.Notify {
+				log.Println(errMsg)
+				return nil
+			}
+			return peer.session.SendNow(&replyMessage{SeqNum: request.SeqNum, Error: errMsg})
+		}
+	}
+	if argIsValue {
+		argv = argv.Elem()
+	}
+
+	if !request.Notify {
+		peer.callMutex.Lock()
+		peer.calls[request.SeqNum] = cancel
+		if stream != nil {
+			peer.streams[request.SeqNum] = stream
+		}
+		peer.callMutex.Unlock()
+	}
+	if m.Streaming == streamArgs {
+		// the caller send args after the window granted
+		if err := stream.grant(cap(stream.recv)); err != nil {
+			peer.callMutex.Lock()
+			delete(peer.calls, request.SeqNum)
+			delete(peer.streams, request.SeqNum)
+			peer.callMutex.Unlock()
+			cancel()
+			releaseSlot(peer.slots)
+			return err
+		}
+	}
+
+	// invoke the method in a new goroutine, so the cancel message can be received
+	go peer.call(ctx, cancel, &request, m, argv, stream)
+	return nil
+}
+
+func (peer *Peer) call(ctx context.Context, cancel context.CancelFunc, request *requestMessage, m *rpcMethod, argv reflect.Value, stream *Stream) {
+	defer func() {
+		if !request.Notify {
+			peer.callMutex.Lock()
+			delete(peer.calls, request.SeqNum)
+			delete(peer.streams, request.SeqNum)
+			peer.callMutex.Unlock()
+		}
+		if stream != nil {
+			stream.finish(StreamClosedError, nil)
+		}
+		cancel()
+		releaseSlot(peer.slots)
+	}()
+
+	reply := &replyMessage{SeqNum: request.SeqNum}
+	sendReply := func() {
+		if request.Notify {
+			if reply.Error != "" {
+				log.Println("RPC notification", m.Service.Name+"."+m.Name, "failed:", reply.Error)
+			}
+			return
+		}
+		peer.session.SendNow(reply)
+	}
+
+	// wait the method slot first, so the waiting calls don't hold the server slots
+	if err := acquireSlot(ctx, m.slots); err != nil {
+		reply.Error = err.Error()
+		sendReply()
+		return
+	}
+	defer releaseSlot(m.slots)
+	if err := acquireSlot(ctx, peer.serverSlots); err != nil {
+		reply.Error = err.Error()
+		sendReply()
+		return
+	}
+	defer releaseSlot(peer.serverSlots)
+
+	defer func() {
+		if e := recover(); e != nil {
+			log.Println("RPC error:", e)
+			reply.Error = "RPC failed"
+			reply.Reply = nil
+			sendReply()
+		}
+	}()
+
+	var replyv reflect.Value
+	if m.Streaming == streamReplies {
+		replyv = reflect.ValueOf(stream)
+	} else {
+		replyv = reflect.New(m.ReplyType.Elem())
+	}
+	err := peer.invoke(ctx, m, request.Notify, argv, replyv)
+	reply.Metadata = getReplyMetadata(ctx)
+
+	if ctx.Err() == context.Canceled {
+		// the caller gave up
+		return
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	} else if !request.Notify && m.Streaming != streamReplies {
+		if reply.Reply, err = peer.codec.Marshal(replyv.Interface()); err != nil {
+			reply.Error = "RPC encode reply failed: " + err.Error()
+		}
+	}
+	sendReply()
+}
+
+// Returns nil slots when no limit.
+func newSlots(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	return make(chan struct{}, limit)
+}
+
+func acquireSlot(ctx context.Context, slots chan struct{}) error {
+	if slots == nil {
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns false when the slots is full.
+func tryAcquireSlot(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
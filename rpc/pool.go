@@ -0,0 +1,300 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors
+var (
+	NoEndpointError = errors.New("RPC no available endpoint")
+	PoolClosedError = errors.New("RPC pool closed")
+)
+
+// How the pool choose a session for a call.
+type Balancer int
+
+const (
+	RoundRobin   Balancer = iota // Use the sessions in turn.
+	LeastPending                 // Use the session has the least pending calls.
+)
+
+var (
+	DefaultRedialInterval = time.Second // Default interval of redialing a failed endpoint.
+)
+
+// A client of several sessions to one or several addresses. The failed sessions are removed
+// when closed, and redialed in background until the pool closed.
+// The idempotent calls failed with ConnectionLostError are retried once on another session.
+// The streaming calls are not supported, use the Client instead.
+type Pool struct {
+	network        string
+	codec          Codec
+	balancer       Balancer
+	redialInterval time.Duration
+	setup          func(*Client) error
+
+	mutex      sync.Mutex
+	endpoints  []*endpoint
+	next       int
+	closed     bool
+	closeChan  chan struct{}
+	idempotent map[string]bool
+}
+
+// One session of the pool.
+type endpoint struct {
+	address string
+	client  *Client // nil when disconnected
+	pending int64   // How mush calls are waiting reply.
+}
+
+// Dial size sessions to each address. It returns NoEndpointError when all addresses failed,
+// the failed addresses are redialed in background when some address succeed.
+func DialPool(network string, addresses []string, size int, codec Codec, balancer Balancer) (*Pool, error) {
+	return DialPoolSetup(network, addresses, size, codec, balancer, nil)
+}
+
+// Dial the pool like DialPool. The setup is invoked on each new session before the pool use it,
+// include the redialed ones, so the services and interceptors can be added by UseClient and Register.
+// The session is closed and redialed when the setup returns an error.
+func DialPoolSetup(network string, addresses []string, size int, codec Codec, balancer Balancer, setup func(*Client) error) (*Pool, error) {
+	pool := &Pool{
+		network:        network,
+		codec:          codec,
+		balancer:       balancer,
+		redialInterval: DefaultRedialInterval,
+		setup:          setup,
+		closeChan:      make(chan struct{}),
+		idempotent:     make(map[string]bool),
+	}
+	for _, address := range addresses {
+		for i := 0; i < size; i++ {
+			pool.endpoints = append(pool.endpoints, &endpoint{address: address})
+		}
+	}
+
+	var failed []*endpoint
+	for _, e := range pool.endpoints {
+		if pool.connect(e) != nil {
+			failed = append(failed, e)
+		}
+	}
+	if len(failed) == len(pool.endpoints) {
+		pool.Close()
+		return nil, NoEndpointError
+	}
+	for _, e := range failed {
+		go pool.redial(e)
+	}
+	return pool, nil
+}
+
+func (pool *Pool) connect(e *endpoint) error {
+	client, err := DialCodec(pool.network, e.address, pool.codec)
+	if err != nil {
+		return err
+	}
+	if pool.setup != nil {
+		if err := pool.setup(client); err != nil {
+			client.Close()
+			return err
+		}
+	}
+
+	pool.mutex.Lock()
+	if pool.closed {
+		pool.mutex.Unlock()
+		client.Close()
+		return PoolClosedError
+	}
+	e.client = client
+	pool.mutex.Unlock()
+
+	client.Session().AddCloseCallback(func() {
+		pool.disconnected(e, client)
+	})
+	if client.Session().IsClosed() {
+		pool.disconnected(e, client)
+	}
+	return nil
+}
+
+// Remove the closed session and redial it.
+func (pool *Pool) disconnected(e *endpoint, client *Client) {
+	pool.mutex.Lock()
+	if e.client != client {
+		pool.mutex.Unlock()
+		return
+	}
+	e.client = nil
+	closed := pool.closed
+	pool.mutex.Unlock()
+
+	if !closed {
+		go pool.redial(e)
+	}
+}
+
+func (pool *Pool) redial(e *endpoint) {
+	for {
+		select {
+		case <-pool.closeChan:
+			return
+		case <-time.After(pool.redialInterval):
+		}
+		if err := pool.connect(e); err == nil || err == PoolClosedError {
+			return
+		}
+	}
+}
+
+// Choose a connected session by the balancer, the excluded one is skipped.
+func (pool *Pool) pick(exclude *endpoint) (*endpoint, *Client, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.closed {
+		return nil, nil, PoolClosedError
+	}
+
+	var chosen *endpoint
+	n := len(pool.endpoints)
+	for i := 0; i < n; i++ {
+		// begin from the next one, so the sessions have the same pending calls are used in turn
+		e := pool.endpoints[(pool.next+i)%n]
+		if e.client == nil || e == exclude {
+			continue
+		}
+		if pool.balancer != LeastPending {
+			chosen = e
+			break
+		}
+		if chosen == nil || atomic.LoadInt64(&e.pending) < atomic.LoadInt64(&chosen.pending) {
+			chosen = e
+		}
+	}
+	if chosen == nil {
+		return nil, nil, NoEndpointError
+	}
+	for i := 0; i < n; i++ {
+		if pool.endpoints[i] == chosen {
+			pool.next = i + 1
+			break
+		}
+	}
+	return chosen, chosen.client, nil
+}
+
+// How mush sessions are connected.
+func (pool *Pool) Available() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	n := 0
+	for _, e := range pool.endpoints {
+		if e.client != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Invoke the function synchronously.
+func (pool *Pool) Call(serviceMethod string, args, reply interface{}) error {
+	return pool.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// Mark the methods are safe to invoke more than once, the calls of them failed with
+// ConnectionLostError are retried once on another session.
+func (pool *Pool) SetIdempotent(serviceMethods ...string) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for _, serviceMethod := range serviceMethods {
+		pool.idempotent[serviceMethod] = true
+	}
+}
+
+// Invoke the function synchronously, see Peer.CallContext.
+func (pool *Pool) CallContext(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	e, err := pool.call(ctx, nil, serviceMethod, args, reply)
+	if err != ConnectionLostError || ctx.Err() != nil {
+		return err
+	}
+	pool.mutex.Lock()
+	retry := pool.idempotent[serviceMethod]
+	pool.mutex.Unlock()
+	if !retry {
+		return err
+	}
+	if _, retryErr := pool.call(ctx, e, serviceMethod, args, reply); retryErr != NoEndpointError {
+		return retryErr
+	}
+	return err
+}
+
+func (pool *Pool) call(ctx context.Context, exclude *endpoint, serviceMethod string, args, reply interface{}) (*endpoint, error) {
+	e, client, err := pool.pick(exclude)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&e.pending, 1)
+	defer atomic.AddInt64(&e.pending, -1)
+	return e, client.CallContext(ctx, serviceMethod, args, reply)
+}
+
+// Invoke the function asynchronously, see Peer.Go.
+func (pool *Pool) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 1)
+	} else if cap(done) == 0 {
+		panic("rpc: done channel is unbuffered")
+	}
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          done,
+	}
+	go func() {
+		call.Error = pool.Call(serviceMethod, args, reply)
+		call.done()
+	}()
+	return call
+}
+
+// Invoke the function without reply, see Peer.Notify.
+func (pool *Pool) Notify(serviceMethod string, args interface{}) error {
+	_, client, err := pool.pick(nil)
+	if err != nil {
+		return err
+	}
+	return client.Notify(serviceMethod, args)
+}
+
+// Close the sessions and stop redialing.
+func (pool *Pool) Close() {
+	pool.mutex.Lock()
+	if pool.closed {
+		pool.mutex.Unlock()
+		return
+	}
+	pool.closed = true
+	close(pool.closeChan)
+	var clients []*Client
+	for _, e := range pool.endpoints {
+		if e.client != nil {
+			clients = append(clients, e.client)
+		}
+	}
+	pool.mutex.Unlock()
+
+	// close outside the lock, the close callbacks lock the pool
+	for _, client := range clients {
+		client.Close()
+	}
+}
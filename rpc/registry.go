@@ -0,0 +1,323 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+type rpcService struct {
+	Name     string
+	Receiver reflect.Value
+	Methods  []*rpcMethod
+}
+
+type rpcMethod struct {
+	Id          uint64 // Begins from 1, 0 means the request use names.
+	Service     *rpcService
+	Name        string
+	Method      reflect.Method
+	ArgsType    reflect.Type
+	ReplyType   reflect.Type
+	WithContext bool          // The first parameter is context.Context.
+	Streaming   int           // streamNone, streamArgs or streamReplies.
+	slots       chan struct{} // limit the concurrent calls of method
+}
+
+// The streaming methods receive a *Stream as args or reply.
+const (
+	streamNone    = 0
+	streamArgs    = 1 // Method(stream *Stream, reply *T), the client streaming
+	streamReplies = 2 // Method(args T, stream *Stream), the server streaming
+)
+
+// Invoke the method, the argv and replyv are the values of the parameters.
+func (m *rpcMethod) call(ctx context.Context, argv, replyv reflect.Value) error {
+	in := []reflect.Value{m.Service.Receiver, argv, replyv}
+	if m.WithContext {
+		in = []reflect.Value{m.Service.Receiver, reflect.ValueOf(ctx), argv, replyv}
+	}
+	returnValues := m.Method.Func.Call(in)
+	if errInterface := returnValues[0].Interface(); errInterface != nil {
+		return errInterface.(error)
+	}
+	return nil
+}
+
+// The registered services. The methods are indexed by "Service.Method" and by id.
+type registry struct {
+	mutex      sync.RWMutex
+	services   []*rpcService
+	methods    map[string]*rpcMethod
+	methodList []*rpcMethod // the method id is index + 1
+}
+
+// The description of a service returned by _rpc.List.
+type ServiceInfo struct {
+	Name    string
+	Methods []MethodInfo
+}
+
+// The description of a method returned by _rpc.List.
+type MethodInfo struct {
+	Name      string
+	Id        uint64
+	ArgsType  string
+	ReplyType string
+}
+
+func newRegistry() *registry {
+	return &registry{
+		methods: make(map[string]*rpcMethod),
+	}
+}
+
+func (registry *registry) getMethod(service, method string) *rpcMethod {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	return registry.methods[service+"."+method]
+}
+
+func (registry *registry) getMethodById(id uint64) *rpcMethod {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	if id == 0 || id > uint64(len(registry.methodList)) {
+		return nil
+	}
+	return registry.methodList[id-1]
+}
+
+// The "Service.Method" names in id order, each name is {len:uvarint}{name}.
+// It is sent to the client in the handshake reply.
+func (registry *registry) methodTable() []byte {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	size := 0
+	for _, m := range registry.methodList {
+		name := m.Service.Name + "." + m.Name
+		size += uvarintSize(uint64(len(name))) + len(name)
+	}
+	table := make([]byte, size)
+	n := 0
+	for _, m := range registry.methodList {
+		n += putString(table[n:], m.Service.Name+"."+m.Name)
+	}
+	return table
+}
+
+// Parse the method table, the method id is index + 1.
+func parseMethodTable(table []byte) (map[string]uint64, error) {
+	ids := make(map[string]uint64)
+	for len(table) > 0 {
+		name, rest, ok := getString(table)
+		if !ok {
+			return nil, BadMessageError
+		}
+		ids[name] = uint64(len(ids) + 1)
+		table = rest
+	}
+	return ids, nil
+}
+
+// The services sorted by name, all services when name is empty.
+func (registry *registry) list(name string) []ServiceInfo {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	services := make([]ServiceInfo, 0, len(registry.services))
+	for _, s := range registry.services {
+		if name != "" && s.Name != name {
+			continue
+		}
+		info := ServiceInfo{Name: s.Name}
+		for _, m := range s.Methods {
+			info.Methods = append(info.Methods, MethodInfo{
+				Name:      m.Name,
+				Id:        m.Id,
+				ArgsType:  m.ArgsType.String(),
+				ReplyType: m.ReplyType.String(),
+			})
+		}
+		services = append(services, info)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
+
+// The built-in service named "_rpc".
+type builtinService struct {
+	registry *registry
+}
+
+// List the registered services, the args is a service name or empty for all services.
+func (s *builtinService) List(name string, reply *[]ServiceInfo) error {
+	*reply = s.registry.list(name)
+	return nil
+}
+
+func (registry *registry) register(name string, service interface{}) error {
+	var (
+		serviceType  = reflect.TypeOf(service)
+		serviceValue = reflect.ValueOf(service)
+	)
+
+	sname := name
+
+	if sname == "" {
+		sname = reflect.Indirect(serviceValue).Type().Name()
+	}
+
+	if sname == "" {
+		err := "RPC no service name for type: " + serviceType.String()
+		log.Println(err)
+		return errors.New(err)
+	}
+
+	if !isExported(sname) && name == "" {
+		err := "RPC service type " + sname + " is not exported"
+		log.Println(err)
+		return errors.New(err)
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	for i := 0; i < len(registry.services); i++ {
+		if registry.services[i].Name == sname {
+			return errors.New("RPC service already defined: " + sname)
+		}
+	}
+
+	serviceInfo := &rpcService{
+		Name:     sname,
+		Receiver: serviceValue,
+		Methods:  getRpcMethods(serviceType, true),
+	}
+
+	if len(serviceInfo.Methods) == 0 {
+		err := ""
+		// To help the user, see if a pointer receiver would work.
+		methods := getRpcMethods(reflect.PtrTo(serviceType), false)
+		if len(methods) != 0 {
+			err = "rpc.Register: type " + sname + " has no exported methods of suitable type (hint: pass a pointer to value of that type)"
+		} else {
+			err = "rpc.Register: type " + sname + " has no exported methods of suitable type"
+		}
+		log.Print(err)
+		return errors.New(err)
+	}
+
+	registry.services = append(registry.services, serviceInfo)
+	for _, m := range serviceInfo.Methods {
+		m.Service = serviceInfo
+		m.Id = uint64(len(registry.methodList) + 1)
+		registry.methodList = append(registry.methodList, m)
+		registry.methods[sname+"."+m.Name] = m
+	}
+
+	return nil
+}
+
+func getRpcMethods(serviceType reflect.Type, reportError bool) []*rpcMethod {
+	methods := make([]*rpcMethod, 0, serviceType.NumMethod())
+	for i := 0; i < cap(methods); i++ {
+		var (
+			method     = serviceType.Method(i)
+			methodType = method.Type
+		)
+
+		// Method(args, reply) or Method(ctx, args, reply), the args or reply can be a *Stream
+		withContext := methodType.NumIn() == 4 && methodType.In(1) == typeOfContext
+		if methodType.NumIn() != 3 && !withContext {
+			if reportError {
+				log.Println("RPC method", method.Name, "has wrong number of parameter:", methodType.NumIn())
+			}
+			continue
+		}
+
+		var methodInfo = &rpcMethod{
+			Name:        method.Name,
+			Method:      method,
+			ArgsType:    methodType.In(methodType.NumIn() - 2),
+			ReplyType:   methodType.In(methodType.NumIn() - 1),
+			WithContext: withContext,
+		}
+
+		if !isExportedOrBuiltinType(methodInfo.ArgsType) {
+			if reportError {
+				log.Println("RPC method", method.Name, "argument type not exported:", methodInfo.ArgsType)
+			}
+			continue
+		}
+
+		if !isExportedOrBuiltinType(methodInfo.ReplyType) {
+			if reportError {
+				log.Println("RPC method", method.Name, "reply type not exported:", methodInfo.ReplyType)
+			}
+			continue
+		}
+
+		if methodInfo.ReplyType.Kind() != reflect.Ptr {
+			if reportError {
+				log.Println("RPC method", method.Name, "reply type not a pointer:", methodInfo.ReplyType)
+			}
+			continue
+		}
+
+		if methodInfo.ArgsType == typeOfStream && methodInfo.ReplyType == typeOfStream {
+			if reportError {
+				log.Println("RPC method", method.Name, "can't stream both args and replies")
+			}
+			continue
+		} else if methodInfo.ArgsType == typeOfStream {
+			methodInfo.Streaming = streamArgs
+		} else if methodInfo.ReplyType == typeOfStream {
+			methodInfo.Streaming = streamReplies
+		}
+
+		if methodType.NumOut() != 1 {
+			if reportError {
+				log.Println("RPC method", method.Name, "wrong number of return value:", methodType.NumOut())
+			}
+			continue
+		}
+
+		if returnType := methodType.Out(0); returnType != typeOfError {
+			if reportError {
+				log.Println("RPC method", method.Name, "return type not error:", returnType)
+			}
+			continue
+		}
+
+		methods = append(methods, methodInfo)
+	}
+	return methods
+}
+
+// NOTE: This code copy from default rpc package.
+// Is this an exported - upper case - name?
+func isExported(name string) bool {
+	rune, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(rune)
+}
+
+// NOTE: This code copy from default rpc package.
+// Is this type exported or a builtin?
+func isExportedOrBuiltinType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// PkgPath will be non-empty even for an exported type,
+	// so we need to check the type name as well.
+	return isExported(t.Name()) || t.PkgPath() == ""
+}
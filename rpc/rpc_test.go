@@ -1,11 +1,20 @@
 package rpc
 
 import (
-	"github.com/funny/jsonrpc"
-	"github.com/funny/unitest"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	netrpc "net/rpc"
+	"net/rpc/jsonrpc"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 type Arith int
@@ -19,47 +28,929 @@ func (t *Arith) Multiply(args *Args, reply *int) error {
 	return nil
 }
 
+func (t *Arith) Divide(args Args, reply *int) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	*reply = args.A / args.B
+	return nil
+}
+
+// The binary codec args, like the gogo protobuf generated types.
+type BinaryArgs struct {
+	A, B int32
+}
+
+func (args *BinaryArgs) Size() int {
+	return 8
+}
+
+func (args *BinaryArgs) MarshalTo(data []byte) (int, error) {
+	binary.LittleEndian.PutUint32(data, uint32(args.A))
+	binary.LittleEndian.PutUint32(data[4:], uint32(args.B))
+	return 8, nil
+}
+
+func (args *BinaryArgs) Unmarshal(data []byte) error {
+	if len(data) < 8 {
+		return errors.New("bad BinaryArgs")
+	}
+	args.A = int32(binary.LittleEndian.Uint32(data))
+	args.B = int32(binary.LittleEndian.Uint32(data[4:]))
+	return nil
+}
+
+// Reply A * B in A.
+func (t *Arith) MultiplyBinary(args *BinaryArgs, reply *BinaryArgs) error {
+	reply.A = args.A * args.B
+	return nil
+}
+
+func newTestServer(t testing.TB) *Server {
+	server, err := NewServer("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	assert.Nil(t, server.Register(new(Arith)))
+	go server.Serve()
+	return server
+}
+
 func Test_RPC(t *testing.T) {
-	server, err := NewServer("tcp", "0.0.0.0:12345")
-	unitest.NotError(t, err)
+	server := newTestServer(t)
+	defer server.Stop()
+
+	client, err := Dial("tcp", server.server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	var reply int
+	assert.Nil(t, client.Call("Arith.Multiply", &Args{7, 8}, &reply))
+	assert.Equal(t, 56, reply)
+
+	assert.Nil(t, client.Call("Arith.Divide", Args{56, 8}, &reply))
+	assert.Equal(t, 7, reply)
+
+	assert.EqualError(t, client.Call("Arith.Divide", Args{56, 0}, &reply), "divide by zero")
+	assert.EqualError(t, client.Call("Arith.Add", Args{1, 2}, &reply), "RPC service not exists: Arith.Add")
+	assert.NotNil(t, client.Call("Arith", Args{1, 2}, &reply))
+
+	// the bad argument only fail the call
+	err = client.Call("Arith.Multiply", "bad", &reply)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "RPC decode request argument failed")
+	assert.Nil(t, client.Call("Arith.Multiply", &Args{2, 3}, &reply))
+	assert.Equal(t, 6, reply)
+}
+
+func Test_RPC_MethodId(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+
+	client, err := Dial("tcp", server.server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	id := client.methodIds["Arith.Multiply"]
+	assert.NotEqual(t, uint64(0), id)
+	assert.Equal(t, "Multiply", server.registry.getMethodById(id).Name)
+	assert.Nil(t, server.registry.getMethodById(0))
+	assert.Nil(t, server.registry.getMethodById(uint64(len(client.methodIds)+1)))
+
+	// the service registered after connected is called by name
+	assert.Nil(t, server.Register(&Gate{}))
+	var reply int
+	assert.Nil(t, client.Call("Gate.Echo", 7, &reply))
+	assert.Equal(t, 7, reply)
+	assert.Nil(t, client.Call("Arith.Multiply", &Args{7, 8}, &reply))
+	assert.Equal(t, 56, reply)
+
+	client.methodIds["Arith.Unknown"] = 1000
+	assert.EqualError(t, client.Call("Arith.Unknown", &Args{7, 8}, &reply), "RPC method id not exists: 1000")
+}
+
+func Test_RPC_List(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+
+	client, err := Dial("tcp", server.server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	var services []ServiceInfo
+	assert.Nil(t, client.Call("_rpc.List", "", &services))
+	assert.Equal(t, 2, len(services))
+	assert.Equal(t, "Arith", services[0].Name)
+	assert.Equal(t, "_rpc", services[1].Name)
+
+	assert.Nil(t, client.Call("_rpc.List", "Arith", &services))
+	assert.Equal(t, 1, len(services))
+	assert.Equal(t, []MethodInfo{
+		{"Divide", client.methodIds["Arith.Divide"], "rpc.Args", "*int"},
+		{"Multiply", client.methodIds["Arith.Multiply"], "*rpc.Args", "*int"},
+		{"MultiplyBinary", client.methodIds["Arith.MultiplyBinary"], "*rpc.BinaryArgs", "*rpc.BinaryArgs"},
+	}, services[0].Methods)
+}
+
+// The service of one connection on the server side.
+type Counter struct {
+	n        int
+	notified chan string
+}
+
+func (c *Counter) Add(delta int, reply *int) error {
+	c.n += delta
+	*reply = c.n
+	return nil
+}
+
+func (c *Counter) Notify(msg string, reply *int) error {
+	c.notified <- msg
+	return nil
+}
+
+// The service on the client side.
+type Notice struct {
+	notified chan string
+}
+
+func (n *Notice) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func (n *Notice) Notify(msg string, reply *int) error {
+	n.notified <- msg
+	return errors.New("the error of notification is dropped")
+}
+
+func Test_RPC_Bidirectional(t *testing.T) {
+	server, err := NewServer("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Stop()
+	peers := make(chan *Peer, 2)
+	notified := make(chan string, 2)
+	server.OnConnect = func(peer *Peer) {
+		assert.Nil(t, peer.Register(&Counter{notified: notified}))
+		peers <- peer
+	}
+	go server.Serve()
+	address := server.server.Listener().Addr().String()
+
+	client1, err := Dial("tcp", address)
+	assert.Nil(t, err)
+	defer client1.Close()
+	notice := &Notice{make(chan string, 1)}
+	assert.Nil(t, client1.Register(notice))
+	peer1 := <-peers
+
+	client2, err := Dial("tcp", address)
+	assert.Nil(t, err)
+	defer client2.Close()
+	<-peers
+
+	// the services of connection
+	var n int
+	assert.Nil(t, client1.Call("Counter.Add", 2, &n))
+	assert.Nil(t, client1.Call("Counter.Add", 3, &n))
+	assert.Equal(t, 5, n)
+	assert.Nil(t, client2.Call("Counter.Add", 1, &n))
+	assert.Equal(t, 1, n)
+	assert.Nil(t, client1.Notify("Counter.Notify", "hello"))
+	assert.Equal(t, "hello", <-notified)
+
+	// the server call the client
+	var reply string
+	assert.Nil(t, peer1.Call("Notice.Echo", "hi", &reply))
+	assert.Equal(t, "hi", reply)
+	assert.Nil(t, peer1.Notify("Notice.Notify", "bye"))
+	assert.Equal(t, "bye", <-notice.notified)
+	assert.EqualError(t, peer1.Call("Arith.Multiply", &Args{7, 8}, &n), "RPC service not exists: Arith.Multiply")
+
+	var services []ServiceInfo
+	assert.Nil(t, peer1.Call("_rpc.List", "", &services))
+	assert.Equal(t, 2, len(services))
+	assert.Equal(t, "Notice", services[0].Name)
+
+	// the _rpc.List of server lists the shared services only
+	assert.Nil(t, client2.Call("_rpc.List", "Counter", &services))
+	assert.Equal(t, 0, len(services))
+}
+
+// Call back the client of the connection.
+type Callback struct {
+	peer *Peer
+}
+
+func (c *Callback) Ask(n int, reply *int) error {
+	return c.peer.Call("Answer.Double", n, reply)
+}
+
+type Answer struct {
+	entered chan int
+	release chan int
+}
+
+// Block until released.
+func (a *Answer) Double(n int, reply *int) error {
+	a.entered <- 1
+	<-a.release
+	*reply = n * 2
+	return nil
+}
+
+func Test_RPC_Callback(t *testing.T) {
+	server, err := NewServer("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Stop()
+	server.MaxConnCalls = 4
+	server.OnConnect = func(peer *Peer) {
+		assert.Nil(t, peer.Register(&Callback{peer}))
+	}
+	go server.Serve()
+
+	client, err := Dial("tcp", server.server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+	answer := &Answer{make(chan int), make(chan int)}
+	assert.Nil(t, client.Register(answer))
+
+	// all slots of the connection are used by the handlers calling back
+	done := make(chan *Call, server.MaxConnCalls)
+	for i := 0; i < server.MaxConnCalls; i++ {
+		client.Go("Callback.Ask", i, new(int), done)
+	}
+	for i := 0; i < server.MaxConnCalls; i++ {
+		<-answer.entered
+	}
+
+	// the connection keep reading when the slots are full, so the replies of the callbacks are received
+	assert.EqualError(t, client.Call("Callback.Ask", 100, new(int)), ServerBusyError.Error())
+	close(answer.release)
+	for i := 0; i < server.MaxConnCalls; i++ {
+		select {
+		case call := <-done:
+			assert.Nil(t, call.Error)
+			assert.Equal(t, call.Args.(int)*2, *call.Reply.(*int))
+		case <-time.After(time.Second):
+			t.Fatal("the callbacks deadlocked")
+		}
+	}
+}
+
+type Board struct {
+	sent chan int
+}
+
+// Send n pages.
+func (b *Board) Pages(n int, stream *Stream) error {
+	if n < 0 {
+		return errors.New("bad page count")
+	}
+	for i := 0; i < n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send until the context done.
+func (b *Board) Tail(ctx context.Context, args int, stream *Stream) error {
+	for i := 0; ; i++ {
+		if err := stream.Send(i); err != nil {
+			b.sent <- i
+			return err
+		}
+	}
+}
+
+// Receive nothing until the context done.
+func (b *Board) Hold(stream *Stream, reply *int) error {
+	<-stream.Context().Done()
+	return stream.Context().Err()
+}
+
+func (b *Board) Sum(stream *Stream, reply *int) error {
+	for {
+		var v int
+		err := stream.Recv(&v)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		*reply += v
+	}
+}
+
+func Test_RPC_Stream(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	board := &Board{make(chan int, 1)}
+	assert.Nil(t, server.Register(board))
+
+	client, err := Dial("tcp", server.server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	// the server streaming
+	stream, err := client.OpenStream(context.Background(), "Board.Pages", 100)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		var page int
+		assert.Nil(t, stream.Recv(&page))
+		assert.Equal(t, i, page)
+	}
+	assert.Equal(t, io.EOF, stream.Recv(new(int)))
+
+	stream, err = client.OpenStream(context.Background(), "Board.Pages", -1)
+	assert.Nil(t, err)
+	assert.EqualError(t, stream.Recv(new(int)), "bad page count")
+
+	// the client streaming
+	stream, err = client.OpenStream(context.Background(), "Board.Sum", nil)
+	assert.Nil(t, err)
+	for i := 1; i <= 100; i++ {
+		assert.Nil(t, stream.Send(i))
+	}
+	var sum int
+	assert.Nil(t, stream.CloseAndRecv(&sum))
+	assert.Equal(t, 5050, sum)
+
+	// the sender blocks when the window is full
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err = client.OpenStream(ctx, "Board.Tail", 0)
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.Equal(t, DefaultStreamWindow, <-board.sent)
+	assert.Equal(t, context.Canceled, stream.Recv(new(int)))
+
+	_, err = client.OpenStream(context.Background(), "Board", 0)
+	assert.NotNil(t, err)
+
+	// the sender ignored the window, only the stream is reset
+	stream, err = client.OpenStream(context.Background(), "Board.Hold", nil)
+	assert.Nil(t, err)
+	data, err := client.codec.Marshal(1)
+	assert.Nil(t, err)
+	for i := 0; i <= DefaultStreamWindow; i++ {
+		assert.Nil(t, client.Session().SendNow(&streamMessage{SeqNum: stream.seqNum, Caller: true, Frame: streamData, Data: data}))
+	}
+	assert.EqualError(t, stream.CloseAndRecv(new(int)), StreamWindowError.Error())
+	var reply int
+	assert.Nil(t, client.Call("Arith.Multiply", &Args{7, 8}, &reply))
+	assert.Equal(t, 56, reply)
+}
+
+func Test_RPC_Interceptor(t *testing.T) {
+	server, err := NewServer("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Stop()
+	assert.Nil(t, server.Register(new(Arith)))
+
+	var order []int
+	var mutex sync.Mutex
+	record := func(i int) {
+		mutex.Lock()
+		order = append(order, i)
+		mutex.Unlock()
+	}
+	server.Use(func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error {
+		record(1)
+		assert.NotNil(t, info.Session)
+		if info.ServiceMethod == "Arith.Divide" && args.(Args).B == 0 {
+			return errors.New("denied")
+		}
+		if info.ServiceMethod == "Arith.Multiply" && args.(*Args).A < 0 {
+			// replace the args with a wrong one
+			if args.(*Args).B == 0 {
+				return next(ctx, info, nil, reply)
+			}
+			return next(ctx, info, Args{}, reply)
+		}
+		return next(ctx, info, args, reply)
+	}, func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error {
+		record(2)
+		err := next(ctx, info, args, reply)
+		if info.ServiceMethod == "Arith.Multiply" {
+			// the reply is decoded after the method invoked
+			*reply.(*int) += 1
+		}
+		return err
+	})
+	durations := make(chan string, 10)
+	server.OnConnect = func(peer *Peer) {
+		peer.UseServer(TimeInterceptor(func(serviceMethod string, duration time.Duration, err error) {
+			durations <- serviceMethod
+		}))
+	}
+	go server.Serve()
+
+	client, err := Dial("tcp", server.server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+	client.UseClient(func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error {
+		record(0)
+		return next(ctx, info, args, reply)
+	})
+
+	var reply int
+	assert.Nil(t, client.Call("Arith.Multiply", &Args{7, 8}, &reply))
+	assert.Equal(t, 57, reply)
+	assert.Equal(t, []int{0, 1, 2}, order)
+	assert.Equal(t, "Arith.Multiply", <-durations)
+
+	assert.EqualError(t, client.Call("Arith.Divide", Args{1, 0}, &reply), "denied")
+	assert.Equal(t, []int{0, 1, 2, 0, 1}, order)
+
+	// the interceptors see the async calls
+	call := <-client.Go("Arith.Divide", Args{56, 8}, &reply, nil).Done
+	assert.Nil(t, call.Error)
+	assert.Equal(t, 7, reply)
+	assert.Equal(t, []int{0, 1, 2, 0, 1, 0, 1, 2}, order)
+	assert.Equal(t, "Arith.Divide", <-durations)
+
+	// the args of wrong type fail the call instead of panic
+	assert.EqualError(t, client.Call("Arith.Multiply", &Args{-1, 0}, &reply), ArgumentTypeError.Error())
+	assert.EqualError(t, client.Call("Arith.Multiply", &Args{-1, 1}, &reply), ArgumentTypeError.Error())
+	assert.Nil(t, client.Call("Arith.Multiply", &Args{7, 8}, &reply))
+}
+
+type Identity struct{}
+
+// Reply the user of request, and the version in the reply metadata.
+func (i *Identity) Whoami(ctx context.Context, args int, reply *string) error {
+	*reply = string(MetadataFromContext(ctx)["user"])
+	SetReplyMetadata(ctx, "version", []byte("2"))
+	return nil
+}
+
+func Test_RPC_Metadata(t *testing.T) {
+	server, err := NewServer("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Stop()
+	assert.Nil(t, server.Register(new(Identity)))
+	traces := make(chan string, 1)
+	server.Use(func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error {
+		traces <- string(MetadataFromContext(ctx)["trace"])
+		return next(ctx, info, args, reply)
+	})
+	go server.Serve()
+
+	client, err := Dial("tcp", server.server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+	client.UseClient(func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error {
+		return next(WithMetadata(ctx, Metadata{"trace": []byte("t1")}), info, args, reply)
+	})
+
+	replyMetadata := Metadata{}
+	ctx := WithMetadata(context.Background(), Metadata{"user": []byte("alice")})
+	ctx = WithReplyMetadata(ctx, replyMetadata)
+	var reply string
+	assert.Nil(t, client.CallContext(ctx, "Identity.Whoami", 0, &reply))
+	assert.Equal(t, "alice", reply)
+	assert.Equal(t, "t1", <-traces)
+	assert.Equal(t, Metadata{"version": []byte("2")}, replyMetadata)
+
+	// the metadata without context
+	assert.Nil(t, client.Call("Identity.Whoami", 0, &reply))
+	assert.Equal(t, "", reply)
+	assert.Equal(t, "t1", <-traces)
+
+	assert.Equal(t, Metadata{"a": []byte("2"), "b": []byte("1")}, Metadata{"a": []byte("1")}.Merge(Metadata{"a": []byte("2"), "b": []byte("1")}))
+}
+
+type Where struct {
+	name string
+}
+
+func (w *Where) Name(args int, reply *string) error {
+	*reply = w.name
+	return nil
+}
+
+func newWhereServer(t *testing.T, address, name string) *Server {
+	server, err := NewServer("tcp", address)
+	assert.Nil(t, err)
+	assert.Nil(t, server.Register(&Where{name}))
+	go server.Serve()
+	return server
+}
+
+func waitAvailable(t *testing.T, pool *Pool, n int) {
+	for i := 0; pool.Available() != n; i++ {
+		if i > 1000 {
+			t.Fatalf("available %d, expect %d", pool.Available(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_RPC_Pool(t *testing.T) {
+	defer func(interval time.Duration) {
+		DefaultRedialInterval = interval
+	}(DefaultRedialInterval)
+	DefaultRedialInterval = 10 * time.Millisecond
+
+	server1 := newWhereServer(t, "127.0.0.1:0", "s1")
+	defer server1.Stop()
+	server2 := newWhereServer(t, "127.0.0.1:0", "s2")
+	address2 := server2.server.Listener().Addr().String()
+
+	pool, err := DialPool("tcp", []string{server1.server.Listener().Addr().String(), address2}, 1, JsonCodec, RoundRobin)
+	assert.Nil(t, err)
+	defer pool.Close()
+	assert.Equal(t, 2, pool.Available())
+
+	var names []string
+	for i := 0; i < 4; i++ {
+		var name string
+		assert.Nil(t, pool.Call("Where.Name", 0, &name))
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"s1", "s2", "s1", "s2"}, names)
+
+	// the failed endpoint is removed
+	server2.Stop()
+	waitAvailable(t, pool, 1)
+	for i := 0; i < 2; i++ {
+		var name string
+		call := <-pool.Go("Where.Name", 0, &name, nil).Done
+		assert.Nil(t, call.Error)
+		assert.Equal(t, "s1", name)
+	}
+
+	// and redialed
+	server2 = newWhereServer(t, address2, "s2")
+	defer server2.Stop()
+	waitAvailable(t, pool, 2)
+
+	pool.Close()
+	assert.Equal(t, PoolClosedError, pool.Call("Where.Name", 0, new(string)))
+
+	_, err = DialPool("tcp", []string{"127.0.0.1:0"}, 1, JsonCodec, RoundRobin)
+	assert.Equal(t, NoEndpointError, err)
+}
+
+// Close the connection before reply on the server named s1.
+type Crash struct {
+	peer *Peer
+	name string
+}
+
+func (c *Crash) Name(args int, reply *string) error {
+	if c.name == "s1" {
+		c.peer.Close()
+	}
+	*reply = c.name
+	return nil
+}
+
+func newCrashServer(t *testing.T, name string) *Server {
+	server, err := NewServer("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server.OnConnect = func(peer *Peer) {
+		peer.Register(&Crash{peer, name})
+	}
+	go server.Serve()
+	return server
+}
+
+func Test_RPC_PoolRetry(t *testing.T) {
+	defer func(interval time.Duration) {
+		DefaultRedialInterval = interval
+	}(DefaultRedialInterval)
+	DefaultRedialInterval = 10 * time.Millisecond
+
+	server1 := newCrashServer(t, "s1")
+	defer server1.Stop()
+	server2 := newCrashServer(t, "s2")
+	defer server2.Stop()
+
+	var setups, calls int32
+	pool, err := DialPoolSetup("tcp", []string{
+		server1.server.Listener().Addr().String(),
+		server2.server.Listener().Addr().String(),
+	}, 1, JsonCodec, RoundRobin, func(client *Client) error {
+		atomic.AddInt32(&setups, 1)
+		client.UseClient(func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error {
+			atomic.AddInt32(&calls, 1)
+			return next(ctx, info, args, reply)
+		})
+		return nil
+	})
+	assert.Nil(t, err)
+	defer pool.Close()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&setups))
+
+	// not retried by default
+	var name string
+	assert.Equal(t, ConnectionLostError, pool.Call("Crash.Name", 0, &name))
+	// the redialed session is set up too
+	for atomic.LoadInt32(&setups) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	waitAvailable(t, pool, 2)
+
+	pool.SetIdempotent("Crash.Name")
+	for i := 0; i < 2; i++ {
+		name = ""
+		assert.Nil(t, pool.Call("Crash.Name", 0, &name))
+		assert.Equal(t, "s2", name)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	// the setup failed sessions are not used
+	_, err = DialPoolSetup("tcp", []string{server2.server.Listener().Addr().String()}, 1, JsonCodec, RoundRobin, func(client *Client) error {
+		return errors.New("setup failed")
+	})
+	assert.Equal(t, NoEndpointError, err)
+}
+
+func Test_RPC_PoolLeastPending(t *testing.T) {
+	server, err := NewServer("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Stop()
+	gate := &Gate{release: make(chan int)}
+	assert.Nil(t, server.Register(gate))
+	var connections int32
+	server.OnConnect = func(peer *Peer) {
+		peer.Register(&Where{strconv.Itoa(int(atomic.AddInt32(&connections, 1)))})
+	}
+	go server.Serve()
+
+	pool, err := DialPool("tcp", []string{server.server.Listener().Addr().String()}, 2, JsonCodec, LeastPending)
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	// the first session has a pending call
+	enter := pool.Go("Gate.Enter", 1, new(int), nil)
+	for atomic.LoadInt32(&gate.running) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	var names []string
+	for i := 0; i < 3; i++ {
+		var name string
+		assert.Nil(t, pool.Call("Where.Name", 0, &name))
+		names = append(names, name)
+	}
+	assert.Equal(t, names[0], names[1])
+	assert.Equal(t, names[0], names[2])
 
-	err2 := server.Register(new(Arith))
-	unitest.NotError(t, err2)
+	gate.release <- 1
+	assert.Nil(t, (<-enter.Done).Error)
+	for i := 0; i < 2; i++ {
+		var name string
+		assert.Nil(t, pool.Call("Where.Name", 0, &name))
+		names = append(names, name)
+	}
+	assert.NotEqual(t, names[3], names[4])
+}
+
+func Test_RPC_Codec(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	address := server.server.Listener().Addr().String()
+
+	client, err := DialCodec("tcp", address, GobCodec)
+	assert.Nil(t, err)
+	var reply int
+	assert.Nil(t, client.Call("Arith.Multiply", &Args{7, 8}, &reply))
+	assert.Equal(t, 56, reply)
+	client.Close()
+
+	client, err = DialCodec("tcp", address, BinaryCodec)
+	assert.Nil(t, err)
+	var binaryReply BinaryArgs
+	assert.Nil(t, client.Call("Arith.MultiplyBinary", &BinaryArgs{7, 8}, &binaryReply))
+	assert.Equal(t, int32(56), binaryReply.A)
+	assert.Equal(t, NotBinaryMessageError, client.Call("Arith.Multiply", &Args{7, 8}, &reply))
+	client.Close()
+
+	_, err = DialCodec("tcp", address, unknownCodec{})
+	assert.EqualError(t, err, "RPC unknown codec: unknown")
+}
+
+type unknownCodec struct {
+	jsonCodec
+}
+
+func (unknownCodec) Name() string {
+	return "unknown"
+}
+
+type Slow struct {
+	canceled chan error
+}
 
+// Block until the context done.
+func (s *Slow) Wait(ctx context.Context, args int, reply *int) error {
+	<-ctx.Done()
+	s.canceled <- ctx.Err()
+	return ctx.Err()
+}
+
+func Test_RPC_Async(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Stop()
+	slow := &Slow{make(chan error, 10)}
+	assert.Nil(t, server.Register(slow))
+
+	client, err := Dial("tcp", server.server.Listener().Addr().String())
+	assert.Nil(t, err)
+
+	done := make(chan *Call, 10)
+	for i := 0; i < 10; i++ {
+		client.Go("Arith.Multiply", &Args{i, i}, new(int), done)
+	}
+	for i := 0; i < 10; i++ {
+		call := <-done
+		assert.Nil(t, call.Error)
+		args := call.Args.(*Args)
+		assert.Equal(t, args.A*args.B, *call.Reply.(*int))
+	}
+
+	// the client cancel the call
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	assert.Equal(t, context.Canceled, client.CallContext(ctx, "Slow.Wait", 1, new(int)))
+	assert.Equal(t, context.Canceled, <-slow.canceled)
+
+	// the deadline is sent to the server
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.CallContext(ctx, "Slow.Wait", 1, new(int)))
+	assert.Equal(t, context.DeadlineExceeded, <-slow.canceled)
+
+	// the pending calls fail when the connection lost
+	call := client.Go("Slow.Wait", 1, new(int), nil)
+	client.Close()
+	<-call.Done
+	assert.Equal(t, ConnectionLostError, call.Error)
+	assert.Equal(t, context.Canceled, <-slow.canceled)
+	assert.Equal(t, ConnectionLostError, client.Call("Arith.Multiply", &Args{7, 8}, new(int)))
+}
+
+type Gate struct {
+	running    int32
+	maxRunning int32
+	release    chan int
+}
+
+// Block until released.
+func (g *Gate) Enter(ctx context.Context, args int, reply *int) error {
+	n := atomic.AddInt32(&g.running, 1)
+	defer atomic.AddInt32(&g.running, -1)
+	for {
+		max := atomic.LoadInt32(&g.maxRunning)
+		if n <= max || atomic.CompareAndSwapInt32(&g.maxRunning, max, n) {
+			break
+		}
+	}
+	select {
+	case <-g.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	*reply = args
+	return nil
+}
+
+func (g *Gate) Echo(args int, reply *int) error {
+	*reply = args
+	return nil
+}
+
+func newGateServer(t *testing.T, maxConnCalls int) (*Server, *Gate, *Client) {
+	server, err := NewServer("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server.MaxConnCalls = maxConnCalls
+	gate := &Gate{release: make(chan int)}
+	assert.Nil(t, server.Register(gate))
+	assert.Nil(t, server.SetMethodLimit("Gate.Enter", 2))
+	assert.NotNil(t, server.SetMethodLimit("Gate.Exit", 2))
 	go server.Serve()
 
-	client, err := Dial("tcp", "127.0.0.1:12345")
-	unitest.NotError(t, err)
+	client, err := Dial("tcp", server.server.Listener().Addr().String())
+	assert.Nil(t, err)
+	return server, gate, client
+}
 
+func Test_RPC_Concurrent(t *testing.T) {
+	server, gate, client := newGateServer(t, 10)
+	defer server.Stop()
+	defer client.Close()
+
+	done := make(chan *Call, 5)
+	for i := 0; i < 5; i++ {
+		client.Go("Gate.Enter", i, new(int), done)
+	}
+	for atomic.LoadInt32(&gate.running) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the slow calls don't block the others
 	var reply int
-	err3 := client.Call("Arith.Multiply", &Args{7, 8}, &reply)
-	unitest.NotError(t, err3)
+	assert.Nil(t, client.Call("Gate.Echo", 7, &reply))
+	assert.Equal(t, 7, reply)
+
+	for i := 0; i < 5; i++ {
+		gate.release <- 1
+	}
+	for i := 0; i < 5; i++ {
+		call := <-done
+		assert.Nil(t, call.Error)
+		assert.Equal(t, call.Args, *call.Reply.(*int))
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&gate.maxRunning))
+}
+
+func Test_RPC_ConnLimit(t *testing.T) {
+	server, gate, client := newGateServer(t, 1)
+	defer server.Stop()
+	defer client.Close()
+
+	enter := client.Go("Gate.Enter", 1, new(int), nil)
+	for atomic.LoadInt32(&gate.running) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.EqualError(t, client.Call("Gate.Echo", 2, new(int)), ServerBusyError.Error())
 
-	unitest.Pass(t, reply == 56)
+	gate.release <- 1
+	assert.Nil(t, (<-enter.Done).Error)
+	assert.Nil(t, client.Call("Gate.Echo", 2, new(int)))
+}
+
+func Test_RPC_Message(t *testing.T) {
+	request := &requestMessage{0, "Arith", "Multiply", 12345, 1000, Metadata{"trace": []byte("1")}, []byte(`{"A":1}`), false}
+	data := make([]byte, request.Size())
+	n, err := request.MarshalTo(data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), n)
+
+	var request2 requestMessage
+	assert.Nil(t, request2.Unmarshal(data))
+	assert.Equal(t, *request, request2)
+	assert.Equal(t, BadMessageError, request2.Unmarshal(data[:len("Arith")+4]))
+	assert.Equal(t, BadMessageError, request2.Unmarshal(data[1:]))
+
+	// the names are omitted when call by method id
+	request = &requestMessage{MethodId: 300, SeqNum: 12345, Args: []byte(`{"A":1}`)}
+	data = make([]byte, request.Size())
+	n, err = request.MarshalTo(data)
+	assert.Nil(t, err)
+	assert.Equal(t, 1+2+4+1+1+7, n)
+	assert.Nil(t, request2.Unmarshal(data))
+	assert.Equal(t, *request, request2)
+
+	// the notification has no seq num and timeout
+	request = &requestMessage{Service: "Arith", Method: "Multiply", Args: []byte(`{"A":1}`), Notify: true}
+	data = make([]byte, request.Size())
+	n, err = request.MarshalTo(data)
+	assert.Nil(t, err)
+	assert.Equal(t, 1+1+1+len("Arith")+1+len("Multiply")+1+7, n)
+	assert.Nil(t, request2.Unmarshal(data))
+	assert.Equal(t, *request, request2)
+
+	reply := &replyMessage{12345, "oops", Metadata{"a": []byte("1"), "b": []byte{}}, []byte("1")}
+	data = make([]byte, reply.Size())
+	_, err = reply.MarshalTo(data)
+	assert.Nil(t, err)
+
+	var reply2 replyMessage
+	assert.Nil(t, reply2.Unmarshal(data))
+	assert.Equal(t, *reply, reply2)
+	assert.Equal(t, BadMessageError, reply2.Unmarshal(data[:10]))
 }
 
 func Benchmark_1(b *testing.B) {
 	b.StopTimer()
-	var server = jsonrpc.NewServer()
+	server := netrpc.NewServer()
 	server.Register(new(Arith))
-	var wg sync.WaitGroup
-	wg.Add(1)
-	address := ""
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal("Server TCP:", err)
+	}
+	defer lis.Close()
 	go func() {
-		lis, err := net.Listen("tcp", "127.0.0.1:0")
-		if err != nil {
-			b.Log("Server TCP:", err)
-			return
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
 		}
-		address = lis.Addr().String()
-		wg.Done()
-		server.Accept(lis)
 	}()
-	wg.Wait()
-	var client, err = jsonrpc.Dial("tcp", address)
+	client, err := jsonrpc.Dial("tcp", lis.Addr().String())
 	if err != nil {
 		b.Fatal("Dial:", err)
 	}
+	defer client.Close()
 	b.StartTimer()
 
 	var reply int
@@ -70,22 +961,13 @@ func Benchmark_1(b *testing.B) {
 
 func Benchmark_2(b *testing.B) {
 	b.StopTimer()
-	server, err := NewServer("tcp", "127.0.0.1:0")
-	if err != nil {
-		b.Fatal("NewServer:", err)
-	}
-	server.Register(new(Arith))
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		wg.Done()
-		server.Serve()
-	}()
-	wg.Wait()
+	server := newTestServer(b)
+	defer server.Stop()
 	client, err := Dial("tcp", server.server.Listener().Addr().String())
 	if err != nil {
 		b.Fatal("Dial:", err)
 	}
+	defer client.Close()
 	b.StartTimer()
 
 	var reply int
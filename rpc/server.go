@@ -1,37 +1,39 @@
 package rpc
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"github.com/funny/link"
-	"log"
 	"reflect"
-	"unicode"
-	"unicode/utf8"
+	"strings"
+
+	"github.com/0studio/link"
 )
 
 // NOTE: This code copy from default rpc package.
 // Precompute the reflect type for error.  Can't use error directly
 // because Typeof takes an empty interface value.  This is annoying.
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
-var typeOfSession = reflect.TypeOf((*link.Session)(nil))
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+var (
+	DefaultMaxConnCalls = 64 // Default max concurrent calls of one connection.
+	DefaultMaxCalls     = 0  // Default max concurrent calls of the server, 0 means no limit.
+)
 
 type Server struct {
 	server   *link.Server
-	services []rpcService
-}
+	registry *registry
+	slots    chan struct{} // limit the concurrent calls of server
 
-type rpcService struct {
-	Name     string
-	Receiver reflect.Value
-	Methods  []rpcMethod
-}
+	MaxConnCalls int // Max concurrent calls of one connection, the calls fail with ServerBusyError when reached.
+	MaxCalls     int // Max concurrent calls of the server, 0 means no limit.
+
+	// Invoked after the handshake of a client, before reading the calls of it.
+	// The services registered on the peer only belong to the connection.
+	// It runs in the reading goroutine, so the calls to the client should be made in another goroutine.
+	OnConnect func(peer *Peer)
 
-type rpcMethod struct {
-	Name      string
-	Method    reflect.Method
-	ArgsType  reflect.Type
-	ReplyType reflect.Type
+	interceptors []Interceptor
 }
 
 func NewServer(network, address string) (*Server, error) {
@@ -39,218 +41,77 @@ func NewServer(network, address string) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Server{server, nil}, nil
+	registry := newRegistry()
+	registry.register("_rpc", &builtinService{registry})
+	return &Server{
+		server:       server,
+		registry:     registry,
+		MaxConnCalls: DefaultMaxConnCalls,
+		MaxCalls:     DefaultMaxCalls,
+	}, nil
 }
 
 func (server *Server) Stop() {
 	server.server.Stop()
 }
 
-func (server *Server) Serve() error {
-	return server.server.Serve(func(session *link.Session) {
-		session.Process(func(msg *link.InBuffer) (err error) {
-			defer func() {
-				if e := recover(); e != nil {
-					log.Println("RPC error:", e)
-					err = errors.New("RPC failed")
-				}
-			}()
-			service := msg.ReadString(int(msg.ReadUvarint()))
-			method := msg.ReadString(int(msg.ReadUvarint()))
-			seqNum := msg.ReadUint32LE()
-			for i := 0; i < len(server.services); i++ {
-				s := &server.services[i]
-				if s.Name == service {
-					for j := 0; j < len(s.Methods); j++ {
-						m := &s.Methods[j]
-						if m.Name == method {
-							var argv reflect.Value
-							argIsValue := false
-							if m.ArgsType.Kind() == reflect.Ptr {
-								argv = reflect.New(m.ArgsType.Elem())
-							} else {
-								argv = reflect.New(m.ArgsType)
-								argIsValue = true
-							}
-							if err := json.NewDecoder(msg).Decode(argv.Interface()); err != nil {
-								log.Println("RPC decode request argument failed:", err)
-								return err
-							}
-							if argIsValue {
-								argv = argv.Elem()
-							}
-							replyv := reflect.New(m.ReplyType.Elem())
-							returnValues := m.Method.Func.Call([]reflect.Value{
-								s.Receiver,
-								argv,
-								replyv,
-							})
-							errMsg := ""
-							if errInterface := returnValues[0].Interface(); errInterface != nil {
-								errMsg = errInterface.(error).Error()
-							}
-							return session.Send(link.MessageFunc(func(buffer *link.OutBuffer) error {
-								buffer.WriteUint32LE(seqNum)
-								buffer.WriteUint32LE(uint32(len(errMsg)))
-								buffer.WriteString(errMsg)
-								if errMsg != "" {
-									return nil
-								}
-								return json.NewEncoder(buffer).Encode(replyv.Interface()) // TODO
-							}))
-						}
-					}
-				}
-			}
-			return session.Send(link.MessageFunc(func(buffer *link.OutBuffer) error {
-				err := "RPC service not exists: " + service + "." + method
-				buffer.WriteUint32LE(seqNum)
-				buffer.WriteUint32LE(uint32(len(err)))
-				buffer.WriteString(err)
-				return nil
-			}))
-		})
-	})
-}
-
+// Register the exported methods of the receiver, the service name is the type name of the receiver.
 func (server *Server) Register(service interface{}) error {
-	return server.register("", service)
+	return server.registry.register("", service)
 }
 
+// Register the exported methods of the receiver with the service name.
 func (server *Server) RegisterName(name string, service interface{}) error {
-	return server.register(name, service)
+	return server.registry.register(name, service)
 }
 
-func (server *Server) register(name string, service interface{}) error {
-	var (
-		serviceType  = reflect.TypeOf(service)
-		serviceValue = reflect.ValueOf(service)
-	)
-
-	sname := name
-
-	if sname == "" {
-		sname = reflect.Indirect(serviceValue).Type().Name()
-	}
-
-	if sname == "" {
-		err := "RPC no service name for type: " + serviceType.String()
-		log.Println(err)
-		return errors.New(err)
-	}
-
-	if !isExported(sname) && name == "" {
-		err := "RPC service type " + sname + " is not exported"
-		log.Println(err)
-		return errors.New(err)
-	}
-
-	for i := 0; i < len(server.services); i++ {
-		if server.services[i].Name == sname {
-			return errors.New("RPC service already defined: " + sname)
-		}
-	}
+// Append the interceptors of the calls from all clients. The first interceptor is the outermost.
+// Invoke it before Serve.
+func (server *Server) Use(interceptors ...Interceptor) {
+	server.interceptors = append(server.interceptors, interceptors...)
+}
 
-	serviceInfo := rpcService{
-		Name:     sname,
-		Receiver: serviceValue,
-		Methods:  getRpcMethods(serviceType, true),
+// Limit the concurrent calls of a method, 0 means no limit. Invoke it before Serve.
+func (server *Server) SetMethodLimit(serviceMethod string, limit int) error {
+	names := strings.SplitN(serviceMethod, ".", 2)
+	if len(names) != 2 {
+		return errors.New("RPC service/method ill-formed: " + serviceMethod)
 	}
-
-	if len(serviceInfo.Methods) == 0 {
-		err := ""
-		// To help the user, see if a pointer receiver would work.
-		methods := getRpcMethods(reflect.PtrTo(serviceType), false)
-		if len(methods) != 0 {
-			err = "rpc.Register: type " + sname + " has no exported methods of suitable type (hint: pass a pointer to value of that type)"
-		} else {
-			err = "rpc.Register: type " + sname + " has no exported methods of suitable type"
-		}
-		log.Print(err)
-		return errors.New(err)
+	m := server.registry.getMethod(names[0], names[1])
+	if m == nil {
+		return errors.New("RPC service not exists: " + serviceMethod)
 	}
-
-	server.services = append(server.services, serviceInfo)
-
+	m.slots = newSlots(limit)
 	return nil
 }
 
-func getRpcMethods(serviceType reflect.Type, reportError bool) []rpcMethod {
-	methods := make([]rpcMethod, 0, serviceType.NumMethod())
-	for i := 0; i < cap(methods); i++ {
-		var (
-			method     = serviceType.Method(i)
-			methodType = method.Type
-		)
-
-		if methodType.NumIn() != 3 {
-			if reportError {
-				log.Println("RPC method", method.Name, "has wrong number of parameter:", methodType.NumIn())
-			}
-			continue
-		}
-
-		var methodInfo = rpcMethod{
-			Name:      method.Name,
-			Method:    method,
-			ArgsType:  methodType.In(1),
-			ReplyType: methodType.In(2),
-		}
-
-		if !isExportedOrBuiltinType(methodInfo.ArgsType) {
-			if reportError {
-				log.Println("RPC method", method.Name, "argument type not exported:", methodInfo.ArgsType)
-			}
-			continue
-		}
-
-		if !isExportedOrBuiltinType(methodInfo.ReplyType) {
-			if reportError {
-				log.Println("RPC method", method.Name, "reply type not exported:", methodInfo.ReplyType)
-			}
-			continue
-		}
-
-		if methodInfo.ReplyType.Kind() != reflect.Ptr {
-			if reportError {
-				log.Println("RPC method", method.Name, "reply type not a pointer:", methodInfo.ReplyType)
-			}
-			continue
-		}
-
-		if methodType.NumOut() != 1 {
-			if reportError {
-				log.Println("RPC method", method.Name, "wrong number of return value:", methodType.NumOut())
-			}
-			continue
-		}
-
-		if returnType := methodType.Out(0); returnType != typeOfError {
-			if reportError {
-				log.Println("RPC method", method.Name, "return type not error:", returnType)
+func (server *Server) Serve() error {
+	server.slots = newSlots(server.MaxCalls)
+	return server.server.Serve(func(session link.SessionAble) {
+		peer := newPeer(session, nil, newRegistry(), server.registry)
+		peer.slots = newSlots(server.MaxConnCalls)
+		peer.serverSlots = server.slots
+		peer.serverInterceptors = server.interceptors
+		session.Process(func(msg *link.InBuffer) error {
+			if peer.codec == nil {
+				return server.handshake(peer, msg)
 			}
-			continue
-		}
-
-		methods = append(methods, methodInfo)
-	}
-	return methods
-}
-
-// NOTE: This code copy from default rpc package.
-// Is this an exported - upper case - name?
-func isExported(name string) bool {
-	rune, _ := utf8.DecodeRuneInString(name)
-	return unicode.IsUpper(rune)
+			return peer.decode(msg)
+		})
+	})
 }
 
-// NOTE: This code copy from default rpc package.
-// Is this type exported or a builtin?
-func isExportedOrBuiltinType(t reflect.Type) bool {
-	for t.Kind() == reflect.Ptr {
-		t = t.Elem()
+// The first message is the codec name, the reply carries the method table,
+// so the client can call by method id.
+func (server *Server) handshake(peer *Peer, msg *link.InBuffer) error {
+	name := string(msg.Data[msg.ReadPos:])
+	if peer.codec = getCodec(name); peer.codec == nil {
+		peer.session.SendNow(&replyMessage{Error: "RPC unknown codec: " + name})
+		return UnknownCodecError
+	}
+	err := peer.session.SendNow(&replyMessage{Reply: server.registry.methodTable()})
+	if err == nil && server.OnConnect != nil {
+		server.OnConnect(peer)
 	}
-	// PkgPath will be non-empty even for an exported type,
-	// so we need to check the type name as well.
-	return isExported(t.Name()) || t.PkgPath() == ""
+	return err
 }
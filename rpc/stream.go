@@ -0,0 +1,330 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// Errors
+var (
+	StreamClosedError = errors.New("RPC stream closed")
+	StreamWindowError = errors.New("RPC stream window exceeded")
+)
+
+var (
+	DefaultStreamWindow = 16 // Default max in flight items of one direction of a stream.
+)
+
+var typeOfStream = reflect.TypeOf((*Stream)(nil))
+
+// The items of a streaming call, the items are encoded by the codec of connection.
+//
+// A server streaming method is Method(args T, stream *Stream) error, it sends the items,
+// the caller receives them until io.EOF or the error returned by the method.
+//
+// A client streaming method is Method(stream *Stream, reply *T) error, it receives the items
+// until io.EOF, the caller sends the items and gets the reply by CloseAndRecv.
+//
+// The sender blocks when the receiver has DefaultStreamWindow items not consumed.
+// Send and Recv can be invoked in different goroutines.
+type Stream struct {
+	peer   *Peer
+	seqNum uint32
+	caller bool
+	ctx    context.Context
+
+	recv     chan []byte // the received items
+	recvOnce sync.Once
+	recvDone chan struct{} // closed when no more items
+	recvErr  error         // io.EOF or the error of call
+	consumed int           // the items consumed and not acked
+
+	mutex        sync.Mutex
+	credit       int           // the items can be sent
+	creditSignal chan struct{} // signaled when the credit increased
+
+	doneOnce sync.Once
+	done     chan struct{} // closed when the call finished
+	err      error
+	reply    []byte // the reply of client streaming call
+}
+
+func newStream(ctx context.Context, peer *Peer, caller bool) *Stream {
+	window := DefaultStreamWindow
+	if window <= 0 {
+		window = 1
+	}
+	return &Stream{
+		peer:         peer,
+		caller:       caller,
+		ctx:          ctx,
+		recv:         make(chan []byte, window),
+		recvDone:     make(chan struct{}),
+		creditSignal: make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+// Open a stream to a streaming method of the remote side.
+// For a server streaming method, the args is sent and the items are received by Recv.
+// For a client streaming method, the args must be nil, the items are sent by Send,
+// and the reply is received by CloseAndRecv.
+// The call is canceled when the context done.
+func (peer *Peer) OpenStream(ctx context.Context, serviceMethod string, args interface{}) (*Stream, error) {
+	timeout, err := contextTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := newStream(ctx, peer, true)
+	call := peer.send(&Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Done:          make(chan *Call, 1),
+		stream:        stream,
+		metadata:      outgoingMetadata(ctx),
+		replyMetadata: replyCapture(ctx),
+	}, timeout)
+	select {
+	case <-call.Done:
+		// the streaming call only done when send failed
+		return nil, call.Error
+	default:
+	}
+
+	// the caller doesn't know the method streaming args or replies, so always grant the window
+	if err := stream.grant(cap(stream.recv)); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-stream.done:
+		case <-ctx.Done():
+			if peer.remove(call.seqNum) != nil {
+				if ctx.Err() == context.Canceled {
+					peer.session.SendNow(&cancelMessage{call.seqNum})
+				}
+				stream.finish(ctx.Err(), nil)
+			}
+		}
+	}()
+	return stream, nil
+}
+
+// The context of the call.
+func (stream *Stream) Context() context.Context {
+	return stream.ctx
+}
+
+// Send an item, it blocks when the window of receiver is full.
+func (stream *Stream) Send(v interface{}) error {
+	data, err := stream.peer.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := stream.takeCredit(); err != nil {
+		return err
+	}
+	return stream.peer.session.SendNow(&streamMessage{
+		SeqNum: stream.seqNum,
+		Caller: stream.caller,
+		Frame:  streamData,
+		Data:   data,
+	})
+}
+
+// Receive an item. Returns io.EOF when the stream ended.
+func (stream *Stream) Recv(v interface{}) error {
+	if err := stream.ctx.Err(); err != nil {
+		return err
+	}
+	var data []byte
+	select {
+	case data = <-stream.recv:
+	default:
+		select {
+		case data = <-stream.recv:
+		case <-stream.recvDone:
+			// the items received before the end
+			select {
+			case data = <-stream.recv:
+			default:
+				return stream.recvErr
+			}
+		case <-stream.ctx.Done():
+			return stream.ctx.Err()
+		}
+	}
+
+	stream.consumed++
+	if stream.consumed >= (cap(stream.recv)+1)/2 {
+		if err := stream.grant(stream.consumed); err != nil {
+			return err
+		}
+		stream.consumed = 0
+	}
+	return stream.peer.codec.Unmarshal(data, v)
+}
+
+// Tell the callee no more items of a client streaming call.
+func (stream *Stream) CloseSend() error {
+	if !stream.caller {
+		return nil
+	}
+	return stream.peer.session.SendNow(&streamMessage{
+		SeqNum: stream.seqNum,
+		Caller: true,
+		Frame:  streamEnd,
+	})
+}
+
+// Close the sending and wait the reply of a client streaming call.
+func (stream *Stream) CloseAndRecv(reply interface{}) error {
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	select {
+	case <-stream.done:
+	case <-stream.ctx.Done():
+		return stream.ctx.Err()
+	}
+	if stream.err != io.EOF {
+		return stream.err
+	}
+	return stream.peer.codec.Unmarshal(stream.reply, reply)
+}
+
+// Allow the remote side send more items.
+func (stream *Stream) grant(n int) error {
+	var buffer [binary.MaxVarintLen64]byte
+	return stream.peer.session.SendNow(&streamMessage{
+		SeqNum: stream.seqNum,
+		Caller: stream.caller,
+		Frame:  streamWindow,
+		Data:   buffer[:binary.PutUvarint(buffer[:], uint64(n))],
+	})
+}
+
+func (stream *Stream) takeCredit() error {
+	for {
+		stream.mutex.Lock()
+		if stream.credit > 0 {
+			stream.credit--
+			stream.mutex.Unlock()
+			return nil
+		}
+		stream.mutex.Unlock()
+
+		select {
+		case <-stream.creditSignal:
+		case <-stream.done:
+			if stream.err == io.EOF {
+				return StreamClosedError
+			}
+			return stream.err
+		case <-stream.ctx.Done():
+			return stream.ctx.Err()
+		}
+	}
+}
+
+func (stream *Stream) addCredit(n int) {
+	stream.mutex.Lock()
+	stream.credit += n
+	stream.mutex.Unlock()
+
+	select {
+	case stream.creditSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (stream *Stream) endRecv(err error) {
+	stream.recvOnce.Do(func() {
+		stream.recvErr = err
+		close(stream.recvDone)
+	})
+}
+
+// The call finished, err is io.EOF when the call succeed.
+func (stream *Stream) finish(err error, reply []byte) {
+	stream.endRecv(err)
+	stream.doneOnce.Do(func() {
+		stream.err = err
+		stream.reply = reply
+		close(stream.done)
+	})
+}
+
+func (peer *Peer) decodeStream(data []byte) error {
+	var msg streamMessage
+	if err := msg.Unmarshal(data); err != nil {
+		return err
+	}
+
+	var stream *Stream
+	if msg.Caller {
+		peer.callMutex.Lock()
+		stream = peer.streams[msg.SeqNum]
+		peer.callMutex.Unlock()
+	} else {
+		peer.mutex.Lock()
+		if call := peer.request[msg.SeqNum]; call != nil {
+			stream = call.stream
+		}
+		peer.mutex.Unlock()
+	}
+	if stream == nil {
+		// the call finished or canceled
+		return nil
+	}
+
+	switch msg.Frame {
+	case streamData:
+		select {
+		case stream.recv <- append([]byte(nil), msg.Data...):
+		default:
+			// the remote side ignored the window, only fail this call
+			peer.resetStream(stream)
+		}
+	case streamWindow:
+		n, size := binary.Uvarint(msg.Data)
+		if size <= 0 {
+			return BadMessageError
+		}
+		stream.addCredit(int(n))
+	case streamEnd:
+		stream.endRecv(io.EOF)
+	default:
+		return BadMessageError
+	}
+	return nil
+}
+
+// Fail a call with StreamWindowError and tell the remote side.
+func (peer *Peer) resetStream(stream *Stream) {
+	if stream.caller {
+		if peer.remove(stream.seqNum) != nil {
+			peer.session.SendNow(&cancelMessage{stream.seqNum})
+			stream.finish(StreamWindowError, nil)
+		}
+		return
+	}
+
+	peer.callMutex.Lock()
+	cancel := peer.calls[stream.seqNum]
+	delete(peer.calls, stream.seqNum)
+	delete(peer.streams, stream.seqNum)
+	peer.callMutex.Unlock()
+	if cancel != nil {
+		// the canceled call don't reply, so reply the error here
+		peer.session.SendNow(&replyMessage{SeqNum: stream.seqNum, Error: StreamWindowError.Error()})
+		stream.finish(StreamWindowError, nil)
+		cancel()
+	}
+}
@@ -14,8 +14,10 @@ var (
 	SendToClosedError           = errors.New("Send to closed session")
 	PacketTooLargeforReadError  = errors.New("Packet too large for read")
 	PacketTooLargeForWriteError = errors.New("Packet too large for write")
+	PacketSizeOverflowError     = errors.New("Packet size overflow the header")
 	AsyncSendTimeoutError       = errors.New("Async send timeout")
 	BufferSizeNotEnough         = errors.New("buffer_size_not_enough")
+	ServerStoppedError          = errors.New("Server stopped")
 )
 
 var (
@@ -38,18 +40,22 @@ func Listen(network, address string) (*Server, error) {
 // Server.
 type Server struct {
 	// About network
-	listener    net.Listener
-	protocol    Protocol
-	broadcaster *Broadcaster
+	listeners     []net.Listener
+	listenerMutex sync.Mutex
+	protocol      Protocol
+	broadcaster   *Broadcaster
 
 	// About sessions
 	maxSessionId uint64
-	sessions     map[uint64]*Session
-	sessionMutex sync.Mutex
+	sessions     *sessionTable
+	keys         [keyShardCount]keyShard
 
 	// About server start and stop
-	stopFlag int32
-	stopWait sync.WaitGroup
+	stopFlag   int32
+	stopWait   sync.WaitGroup
+	handler    func(SessionAble)
+	acceptWait sync.WaitGroup
+	serveError error
 
 	SendChanSize         int         // Session send chan buffer size.
 	ReadBufferSize       int         // Session read buffer size.
@@ -57,31 +63,83 @@ type Server struct {
 	isServing            int32       // if this is false ,when new conn coming ,close it directly
 	maxSessionCnt        int
 	sessionTimeScheduler func(SessionAble)
+
+	// Called when a key bound to a new session, the old session will closed when it is nil.
+	OnKeyReplaced func(key string, old, new SessionAble)
+
+	DecoderErrorPolicy DecoderErrorPolicy // How the sessions handle decoder errors.
+	middlewares        []DecoderMiddleware
+	middlewareMutex    sync.RWMutex
 }
 
-// Create a server.
+// Create a server. More listeners can be added by AddListener.
 func NewServer(listener net.Listener, protocol Protocol) *Server {
 	server := &Server{
-		listener:             listener,
 		protocol:             protocol,
-		sessions:             make(map[uint64]*Session),
+		sessions:             newSessionTable(),
 		SendChanSize:         DefaultSendChanSize,
 		ReadBufferSize:       DefaultConnBufferSize,
 		isServing:            1,
 		maxSessionCnt:        DefaultMaxSessionCnt,
 		sessionTimeScheduler: DefauntSessionTimeScheduler,
+		DecoderErrorPolicy:   DefaultDecoderErrorPolicy,
+	}
+	if listener != nil {
+		server.listeners = append(server.listeners, listener)
+	}
+	for i := range server.keys {
+		server.keys[i].bindings = make(map[string]*keyBinding)
 	}
 	protocolState, _ := protocol.New(server, SERVER_SIDE)
 	server.broadcaster = NewBroadcaster(protocolState, server.fetchSession)
 	return server
 }
 
-// Get listener address.
+// Get the first listener.
 func (server *Server) Listener() net.Listener {
-	return server.listener
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+
+	if len(server.listeners) == 0 {
+		return nil
+	}
+	return server.listeners[0]
+}
+
+// Get all listeners.
+func (server *Server) Listeners() []net.Listener {
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+
+	listeners := make([]net.Listener, len(server.listeners))
+	copy(listeners, server.listeners)
+	return listeners
+}
+
+// Add a listener. Sessions accepted from all listeners share the session table,
+// the broadcaster and the handler. The listener starts accepting immediately when the server is serving.
+// Returns ServerStoppedError and close the listener when the server stopped.
+func (server *Server) AddListener(listener net.Listener) error {
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+
+	if atomic.LoadInt32(&server.stopFlag) != 0 {
+		listener.Close()
+		return ServerStoppedError
+	}
+	server.listeners = append(server.listeners, listener)
+	if server.handler != nil {
+		server.startAccept(listener)
+	}
+	return nil
 }
 func (server *Server) GetSessionCount() int {
-	return len(server.sessions)
+	return server.sessions.len()
+}
+
+// Get a session by id. Returns nil when not exists.
+func (server *Server) GetSession(id uint64) *Session {
+	return server.sessions.get(id)
 }
 func (server *Server) GetSessions() []*Session {
 	return server.copySessions()
@@ -109,10 +167,18 @@ func (server *Server) Broadcast(message Message, timeout time.Duration) ([]Broad
 	return server.broadcaster.Broadcast(message, timeout)
 }
 
-// Accept incoming connection once.
+// Accept incoming connection once from the first listener.
 func (server *Server) Accept() (*Session, error) {
+	listener := server.Listener()
+	if listener == nil {
+		return nil, ServerStoppedError
+	}
+	return server.acceptFrom(listener)
+}
+
+func (server *Server) acceptFrom(listener net.Listener) (*Session, error) {
 	for {
-		conn, err := server.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			return nil, err
 		}
@@ -120,7 +186,7 @@ func (server *Server) Accept() (*Session, error) {
 			conn.Close()
 			return nil, nil
 		}
-		if server.maxSessionCnt != 0 && len(server.sessions) >= server.maxSessionCnt {
+		if server.maxSessionCnt != 0 && server.GetSessionCount() >= server.maxSessionCnt {
 			conn.Close()
 			fmt.Println("reach_server_session_max_cnt", server.maxSessionCnt, "new conn will be rejected!", time.Now())
 			return nil, nil
@@ -136,27 +202,54 @@ func (server *Server) Accept() (*Session, error) {
 	}
 }
 
-// Loop and accept incoming connections. The callback will called asynchronously when each session start.
-func (server *Server) Serve(handler func(SessionAble)) (err error) {
-	for {
-		err = server.doServe(handler)
-		if err != nil {
-			return err
-		}
+// Loop and accept incoming connections on all listeners. The callback will called asynchronously when each session start.
+// When any listener failed the server will stop. Returns after all accept loops exited with the first accept error.
+func (server *Server) Serve(handler func(SessionAble)) error {
+	server.listenerMutex.Lock()
+	if atomic.LoadInt32(&server.stopFlag) != 0 {
+		server.listenerMutex.Unlock()
+		return ServerStoppedError
 	}
+	server.handler = handler
+	for _, listener := range server.listeners {
+		server.startAccept(listener)
+	}
+	server.listenerMutex.Unlock()
+
+	server.acceptWait.Wait()
+
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+	return server.serveError
+}
+
+// Start a accept loop. Must hold the listener mutex.
+func (server *Server) startAccept(listener net.Listener) {
+	server.acceptWait.Add(1)
+	go func() {
+		defer server.acceptWait.Done()
+		for {
+			if err := server.doServe(listener, server.handler); err != nil {
+				server.listenerMutex.Lock()
+				if server.serveError == nil {
+					server.serveError = err
+				}
+				server.listenerMutex.Unlock()
+				server.Stop()
+				return
+			}
+		}
+	}()
 }
 
-func (server *Server) doServe(handler func(SessionAble)) error {
+func (server *Server) doServe(listener net.Listener, handler func(SessionAble)) error {
 	defer func() {
 		if e := recover(); e != nil {
 			fmt.Println("link.server.ERROR", e)
 		}
 	}()
-	session, err := server.Accept()
+	session, err := server.acceptFrom(listener)
 	if err != nil {
-		if server.Stop() {
-			return err
-		}
 		return err
 	}
 	if session == nil {
@@ -171,7 +264,9 @@ func (server *Server) doServe(handler func(SessionAble)) error {
 // Stop server.
 func (server *Server) Stop() bool {
 	if atomic.CompareAndSwapInt32(&server.stopFlag, 0, 1) {
-		server.listener.Close()
+		for _, listener := range server.Listeners() {
+			listener.Close()
+		}
 		server.closeSessions()
 		server.stopWait.Wait()
 		return true
@@ -179,6 +274,15 @@ func (server *Server) Stop() bool {
 	return false
 }
 
+// Append decoder middlewares for the new sessions.
+// The middlewares wrap the decoder passed to Session.Process, the first one is the outermost.
+func (server *Server) Use(middlewares ...DecoderMiddleware) {
+	server.middlewareMutex.Lock()
+	defer server.middlewareMutex.Unlock()
+
+	server.middlewares = append(server.middlewares, middlewares...)
+}
+
 func (server *Server) newSession(id uint64, conn net.Conn) *Session {
 	if server.ReadBufferSize > 0 {
 		conn = getBufferConnFromPool(conn, server.ReadBufferSize)
@@ -187,53 +291,45 @@ func (server *Server) newSession(id uint64, conn net.Conn) *Session {
 	if session == nil {
 		return nil
 	}
+	server.middlewareMutex.RLock()
+	session.Use(server.middlewares...)
+	server.middlewareMutex.RUnlock()
+	session.SetDecoderErrorPolicy(server.DecoderErrorPolicy)
 	server.putSession(session)
 	return session
 }
 
 // Put a session into session list.
 func (server *Server) putSession(session *Session) {
-	server.sessionMutex.Lock()
-	defer server.sessionMutex.Unlock()
+	server.stopWait.Add(1)
+	server.sessions.put(session)
 
-	session.AddCloseCallback(server, func() {
+	handle := session.AddCloseCallback(func() {
 		server.delSession(session)
 		putBufferConnToPool(session)
 	})
-	server.sessions[session.id] = session
-	server.stopWait.Add(1)
+	if handle == 0 {
+		server.delSession(session)
+	}
 }
 
 // Delete a session from session list.
 func (server *Server) delSession(session *Session) {
-	server.sessionMutex.Lock()
-	defer server.sessionMutex.Unlock()
-
-	session.RemoveCloseCallback(server)
-	delete(server.sessions, session.id)
-	server.stopWait.Done()
+	if server.sessions.del(session) {
+		server.stopWait.Done()
+	}
 }
 
 // Copy sessions for close.
 func (server *Server) copySessions() []*Session {
-	server.sessionMutex.Lock()
-	defer server.sessionMutex.Unlock()
-
-	sessions := make([]*Session, 0, len(server.sessions))
-	for _, session := range server.sessions {
-		sessions = append(sessions, session)
-	}
-	return sessions
+	return server.sessions.copy()
 }
 
-// Fetch sessions.
+// Fetch sessions. The callback invoked without lock.
 func (server *Server) fetchSession(callback func(SessionAble)) {
-	server.sessionMutex.Lock()
-	defer server.sessionMutex.Unlock()
-
-	for _, session := range server.sessions {
+	server.sessions.fetch(func(session *Session) {
 		callback(session)
-	}
+	})
 }
 
 // Close all sessions.
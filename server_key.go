@@ -0,0 +1,113 @@
+package link
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const keyShardCount = 32
+
+// The key index is sharded, so lookups by key don't contend with each other
+// and with the session accept and close.
+type keyShard struct {
+	mutex    sync.RWMutex
+	bindings map[string]*keyBinding
+}
+
+type keyBinding struct {
+	session     SessionAble
+	closeHandle CloseCallbackHandle
+}
+
+func (server *Server) keyShard(key string) *keyShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return &server.keys[hash.Sum32()%keyShardCount]
+}
+
+// Bind an application key (like user id) to a session.
+// The session bound to the key before will be replaced and passed to server.OnKeyReplaced,
+// the old session will closed when server.OnKeyReplaced is nil.
+// The key will unbind automatically when the session closed.
+func (server *Server) BindKey(key string, session SessionAble) (replaced SessionAble) {
+	shard := server.keyShard(key)
+	binding := &keyBinding{session: session}
+
+	shard.mutex.Lock()
+	binding.closeHandle = session.AddCloseCallback(func() {
+		server.unbindKey(key, binding)
+	})
+	if session.IsClosed() {
+		shard.mutex.Unlock()
+		return nil
+	}
+	if old, exists := shard.bindings[key]; exists {
+		old.session.RemoveCloseCallback(old.closeHandle)
+		if old.session != session {
+			replaced = old.session
+		}
+	}
+	shard.bindings[key] = binding
+	shard.mutex.Unlock()
+
+	if replaced != nil {
+		if server.OnKeyReplaced != nil {
+			server.OnKeyReplaced(key, replaced, session)
+		} else {
+			replaced.Close()
+		}
+	}
+	return
+}
+
+// Unbind a key. Returns the session bound to the key.
+func (server *Server) UnbindKey(key string) SessionAble {
+	shard := server.keyShard(key)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if binding, exists := shard.bindings[key]; exists {
+		binding.session.RemoveCloseCallback(binding.closeHandle)
+		delete(shard.bindings, key)
+		return binding.session
+	}
+	return nil
+}
+
+// Get the session bound to a key. Returns nil when not exists.
+func (server *Server) GetSessionByKey(key string) SessionAble {
+	shard := server.keyShard(key)
+
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	if binding, exists := shard.bindings[key]; exists {
+		return binding.session
+	}
+	return nil
+}
+
+// How mush keys bound to sessions.
+func (server *Server) GetKeyCount() int {
+	n := 0
+	for i := range server.keys {
+		shard := &server.keys[i]
+		shard.mutex.RLock()
+		n += len(shard.bindings)
+		shard.mutex.RUnlock()
+	}
+	return n
+}
+
+// Remove a binding when the session closed.
+func (server *Server) unbindKey(key string, binding *keyBinding) {
+	shard := server.keyShard(key)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if shard.bindings[key] == binding {
+		delete(shard.bindings, key)
+	}
+}
@@ -1,6 +1,146 @@
 package link
 
-import "testing"
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func Test_Server(t *testing.T) {
 }
+
+func newTestServer(t *testing.T) (*Server, chan SessionAble) {
+	server, err := Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	sessions := make(chan SessionAble, 10)
+	go server.Serve(func(session SessionAble) {
+		sessions <- session
+		session.Process(func(*InBuffer) error { return nil })
+	})
+	return server, sessions
+}
+
+func TestServerGetSession(t *testing.T) {
+	server, sessions := newTestServer(t)
+	defer server.Stop()
+
+	client, err := Dial("tcp", server.Listener().Addr().String())
+	assert.Nil(t, err)
+	session := <-sessions
+
+	assert.Equal(t, 1, server.GetSessionCount())
+	assert.Equal(t, session, server.GetSession(session.Id()))
+	assert.Nil(t, server.GetSession(session.Id()+1))
+
+	client.Close()
+	waitUntil(t, func() bool {
+		return server.GetSession(session.Id()) == nil
+	})
+}
+
+func TestServerBindKey(t *testing.T) {
+	server, sessions := newTestServer(t)
+	defer server.Stop()
+
+	client1, err := Dial("tcp", server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client1.Close()
+	session1 := <-sessions
+
+	client2, err := Dial("tcp", server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client2.Close()
+	session2 := <-sessions
+
+	assert.Nil(t, server.BindKey("user1", session1))
+	assert.Equal(t, session1, server.GetSessionByKey("user1"))
+
+	assert.Equal(t, session1, server.BindKey("user1", session2))
+	assert.True(t, session1.IsClosed())
+	assert.Equal(t, session2, server.GetSessionByKey("user1"))
+	assert.Equal(t, 1, server.GetKeyCount())
+
+	session2.Close()
+	assert.Nil(t, server.GetSessionByKey("user1"))
+	assert.Equal(t, 0, server.GetKeyCount())
+}
+
+func TestServerKeyReplaced(t *testing.T) {
+	server, sessions := newTestServer(t)
+	defer server.Stop()
+
+	var replaced []SessionAble
+	server.OnKeyReplaced = func(key string, old, new SessionAble) {
+		replaced = append(replaced, old, new)
+	}
+
+	client1, err := Dial("tcp", server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client1.Close()
+	session1 := <-sessions
+
+	client2, err := Dial("tcp", server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer client2.Close()
+	session2 := <-sessions
+
+	server.BindKey("user1", session1)
+	server.BindKey("user1", session2)
+	assert.Equal(t, []SessionAble{session1, session2}, replaced)
+	assert.False(t, session1.IsClosed())
+
+	session1.Close()
+	assert.Equal(t, session2, server.GetSessionByKey("user1"))
+	assert.Equal(t, session2, server.UnbindKey("user1"))
+	assert.Nil(t, server.GetSessionByKey("user1"))
+}
+
+func TestServerMultiListener(t *testing.T) {
+	server, err := Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	unixListener, err := net.Listen("unix", filepath.Join(t.TempDir(), "link.sock"))
+	assert.Nil(t, err)
+	assert.Nil(t, server.AddListener(unixListener))
+
+	serveDone := make(chan error, 1)
+	go func() {
+		serveDone <- server.Serve(func(session SessionAble) {
+			session.Process(func(*InBuffer) error { return nil })
+		})
+	}()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	assert.Nil(t, server.AddListener(tcpListener))
+	assert.Equal(t, 3, len(server.Listeners()))
+
+	var clients []*Session
+	for _, listener := range server.Listeners() {
+		client, err := Dial(listener.Addr().Network(), listener.Addr().String())
+		assert.Nil(t, err)
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	waitUntil(t, func() bool {
+		return server.GetSessionCount() == len(clients)
+	})
+
+	_, err = server.Broadcast(String("hello"), time.Second)
+	assert.Nil(t, err)
+	for _, client := range clients {
+		data, err := client.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(data))
+	}
+
+	assert.True(t, server.Stop())
+	assert.NotNil(t, <-serveDone)
+	assert.Equal(t, 0, server.GetSessionCount())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	assert.Equal(t, ServerStoppedError, server.AddListener(listener))
+}
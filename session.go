@@ -50,12 +50,13 @@ type Session struct {
 	inBuffer            InBuffer
 	outBuffer           OutBuffer
 	outBufferMutex      sync.Mutex
+	decoderChain        decoderChain
+	decoderErrorPolicy  DecoderErrorPolicy
 
 	// About session close
-	closeChan       chan int
-	closeFlag       int32
-	closeEventMutex sync.Mutex
-	closeCallbacks  *list.List
+	closeChan      chan int
+	closeFlag      int32
+	closeCallbacks closeCallbackList
 
 	createTime   time.Time
 	lastSendTime time.Time
@@ -88,9 +89,9 @@ func newSession(id uint64, conn net.Conn, protocol Protocol, side ProtocolSide,
 		inBuffer:            NewInBuffer(),
 		outBuffer:           NewOutBuffer(),
 		closeChan:           make(chan int),
-		closeCallbacks:      list.New(),
 		createTime:          time.Now(),
 		timeScheduler:       timeScheduler,
+		decoderErrorPolicy:  DefaultDecoderErrorPolicy,
 	}
 
 	defer func() {
@@ -194,6 +195,16 @@ func (session *Session) sendBuffer(buffer *OutBuffer) error {
 
 }
 
+// Append decoder middlewares. Invoke it before Process.
+func (session *Session) Use(middlewares ...DecoderMiddleware) {
+	session.decoderChain.use(middlewares...)
+}
+
+// Set how to handle the decoder errors.
+func (session *Session) SetDecoderErrorPolicy(policy DecoderErrorPolicy) {
+	session.decoderErrorPolicy = policy
+}
+
 // Process one request.
 func (session *Session) ProcessOnce(decoder Decoder) error {
 	session.readMutex.Lock()
@@ -207,10 +218,13 @@ func (session *Session) ProcessOnce(decoder Decoder) error {
 	}
 	session.lastRecvTime = time.Now()
 
-	err = decoder(&session.inBuffer)
+	err = session.decoderChain.wrap(decoder)(&session.inBuffer)
 	session.inBuffer.reset()
 
-	return nil
+	if err != nil {
+		err = session.decoderErrorPolicy.handle(session, err)
+	}
+	return err
 }
 
 // Process request.
@@ -354,48 +368,83 @@ func (session *Session) AsyncSendBuffer(buffer *OutBuffer, timeout time.Duration
 	return AsyncWork{c}
 }
 
-type closeCallback struct {
-	Handler interface{}
-	Func    func()
+// The handle of a close callback. Used to remove the callback.
+// The zero value means the callback is not added.
+type CloseCallbackHandle uint64
+
+// Add close callback. Returns a handle to remove the callback.
+// The callback will not added when the session is closed, and the returned handle is zero.
+func (session *Session) AddCloseCallback(callback func()) CloseCallbackHandle {
+	return session.closeCallbacks.add(callback)
 }
 
-// Add close callback.
-func (session *Session) AddCloseCallback(handler interface{}, callback func()) {
-	if session.IsClosed() {
-		return
-	}
+// Remove close callback.
+func (session *Session) RemoveCloseCallback(handle CloseCallbackHandle) {
+	session.closeCallbacks.remove(handle)
+}
 
-	session.closeEventMutex.Lock()
-	defer session.closeEventMutex.Unlock()
+// Dispatch close event.
+func (session *Session) invokeCloseCallbacks() {
+	session.closeCallbacks.invoke()
+}
 
-	session.closeCallbacks.PushBack(closeCallback{handler, callback})
+// The close callbacks of a session. The zero value is ready to use.
+type closeCallbackList struct {
+	mutex      sync.Mutex
+	callbacks  *list.List
+	handles    map[CloseCallbackHandle]*list.Element
+	lastHandle CloseCallbackHandle
+	invoked    bool
 }
 
-// Remove close callback.
-func (session *Session) RemoveCloseCallback(handler interface{}) {
-	if session.IsClosed() {
-		return
+func (l *closeCallbackList) add(callback func()) CloseCallbackHandle {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.invoked {
+		return 0
 	}
+	if l.callbacks == nil {
+		l.callbacks = list.New()
+		l.handles = make(map[CloseCallbackHandle]*list.Element)
+	}
+	l.lastHandle++
+	l.handles[l.lastHandle] = l.callbacks.PushBack(callback)
+	return l.lastHandle
+}
 
-	session.closeEventMutex.Lock()
-	defer session.closeEventMutex.Unlock()
+func (l *closeCallbackList) remove(handle CloseCallbackHandle) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 
-	for i := session.closeCallbacks.Front(); i != nil; i = i.Next() {
-		if i.Value.(closeCallback).Handler == handler {
-			session.closeCallbacks.Remove(i)
-			return
-		}
+	if element, exists := l.handles[handle]; exists {
+		delete(l.handles, handle)
+		l.callbacks.Remove(element)
 	}
 }
 
-// Dispatch close event.
-func (session *Session) invokeCloseCallbacks() {
-	session.closeEventMutex.Lock()
-	defer session.closeEventMutex.Unlock()
+func (l *closeCallbackList) len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.handles)
+}
 
-	for i := session.closeCallbacks.Front(); i != nil; i = i.Next() {
-		callback := i.Value.(closeCallback)
-		callback.Func()
+// Invoke the callbacks once. The callbacks are invoked without lock,
+// so they can add or remove callbacks safely.
+func (l *closeCallbackList) invoke() {
+	l.mutex.Lock()
+	callbacks := l.callbacks
+	l.callbacks = nil
+	l.handles = nil
+	l.invoked = true
+	l.mutex.Unlock()
+
+	if callbacks == nil {
+		return
+	}
+	for i := callbacks.Front(); i != nil; i = i.Next() {
+		i.Value.(func())()
 	}
 }
 
@@ -0,0 +1,113 @@
+package link
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const sessionShardCount = 32
+
+// The session table is sharded to avoid accept, close and lookup serialise on one lock.
+// Each shard keeps an immutable snapshot for iteration, the snapshot rebuilt
+// only when the shard changed, so broadcast don't hold any lock while sending.
+type sessionTable struct {
+	shards [sessionShardCount]sessionShard
+	count  int64
+}
+
+type sessionShard struct {
+	mutex    sync.RWMutex
+	sessions map[uint64]*Session
+	snapshot atomic.Pointer[[]*Session] // nil means the shard changed after last snapshot
+}
+
+func newSessionTable() *sessionTable {
+	table := &sessionTable{}
+	for i := range table.shards {
+		table.shards[i].sessions = make(map[uint64]*Session)
+	}
+	return table
+}
+
+func (table *sessionTable) shard(id uint64) *sessionShard {
+	return &table.shards[id%sessionShardCount]
+}
+
+func (table *sessionTable) put(session *Session) {
+	shard := table.shard(session.id)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if _, exists := shard.sessions[session.id]; !exists {
+		atomic.AddInt64(&table.count, 1)
+	}
+	shard.sessions[session.id] = session
+	shard.snapshot.Store(nil)
+}
+
+// Returns false when the session not exists.
+func (table *sessionTable) del(session *Session) bool {
+	shard := table.shard(session.id)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if shard.sessions[session.id] != session {
+		return false
+	}
+	delete(shard.sessions, session.id)
+	atomic.AddInt64(&table.count, -1)
+	shard.snapshot.Store(nil)
+	return true
+}
+
+func (table *sessionTable) get(id uint64) *Session {
+	shard := table.shard(id)
+
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	return shard.sessions[id]
+}
+
+func (table *sessionTable) len() int {
+	return int(atomic.LoadInt64(&table.count))
+}
+
+// Get the snapshot of a shard. Don't modify the result.
+func (shard *sessionShard) load() []*Session {
+	if snapshot := shard.snapshot.Load(); snapshot != nil {
+		return *snapshot
+	}
+
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	if snapshot := shard.snapshot.Load(); snapshot != nil {
+		return *snapshot
+	}
+	sessions := make([]*Session, 0, len(shard.sessions))
+	for _, session := range shard.sessions {
+		sessions = append(sessions, session)
+	}
+	shard.snapshot.Store(&sessions)
+	return sessions
+}
+
+// Fetch sessions without lock. The sessions put or deleted during fetching may not be seen.
+func (table *sessionTable) fetch(callback func(*Session)) {
+	for i := range table.shards {
+		for _, session := range table.shards[i].load() {
+			callback(session)
+		}
+	}
+}
+
+func (table *sessionTable) copy() []*Session {
+	sessions := make([]*Session, 0, table.len())
+	table.fetch(func(session *Session) {
+		sessions = append(sessions, session)
+	})
+	return sessions
+}
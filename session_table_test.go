@@ -0,0 +1,74 @@
+package link
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionTable(t *testing.T) {
+	table := newSessionTable()
+	sessions := make([]*Session, 1000)
+	for i := range sessions {
+		sessions[i] = &Session{id: uint64(i + 1)}
+		table.put(sessions[i])
+	}
+	assert.Equal(t, 1000, table.len())
+	assert.Equal(t, 1000, len(table.copy()))
+	assert.Equal(t, sessions[10], table.get(11))
+
+	for _, session := range sessions[:500] {
+		assert.True(t, table.del(session))
+		assert.False(t, table.del(session))
+	}
+	assert.Equal(t, 500, table.len())
+	assert.Nil(t, table.get(1))
+
+	n := 0
+	table.fetch(func(session *Session) {
+		assert.True(t, session.id > 500)
+		n++
+	})
+	assert.Equal(t, 500, n)
+}
+
+func TestSessionTableConcurrent(t *testing.T) {
+	table := newSessionTable()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				session := &Session{id: uint64(g*1000 + i + 1)}
+				table.put(session)
+				if i%2 == 0 {
+					table.del(session)
+				}
+			}
+		}(g)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				table.fetch(func(*Session) {})
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 4000, table.len())
+	assert.Equal(t, 4000, len(table.copy()))
+}
+
+func BenchmarkSessionTableFetch(b *testing.B) {
+	table := newSessionTable()
+	for i := 0; i < 200000; i++ {
+		table.put(&Session{id: uint64(i + 1)})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.fetch(func(*Session) {})
+	}
+}
@@ -0,0 +1,930 @@
+package link
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors
+var (
+	UDPPacketTooLargeError   = errors.New("UDP packet too large")
+	UDPSendWindowFullError   = errors.New("UDP send window full")
+	UDPHandshakeTimeoutError = errors.New("UDP handshake timeout")
+	UDPSessionRefusedError   = errors.New("UDP session refused")
+)
+
+var (
+	DefaultUDPMaxPayloadSize     = 1200                   // Max message size of one datagram.
+	DefaultUDPWindowSize         = 1024                   // Max unacked or out of order reliable packets of each channel.
+	DefaultUDPRecvQueueSize      = 1024                   // Received messages waiting for Process.
+	DefaultUDPRetransmitInterval = 100 * time.Millisecond // Retransmit interval of unacked reliable packets.
+	DefaultUDPMaxRetransmit      = 50                     // The session closed when a packet retransmitted too many times.
+	DefaultUDPIdleTimeout        = 30 * time.Second       // The session closed when nothing received in this duration.
+	DefaultUDPHandshakeTimeout   = 5 * time.Second        // The dialing failed when the server not accept in this duration.
+	DefaultUDPMaxSessions        = 10000                  // Max sessions of a server.
+	DefaultUDPMaxBufferedPackets = 4096                   // Max out of order reliable packets buffered by a session.
+)
+
+// {type:uint8}{channel:uint8}{seq:uint32 little endian}{payload}
+const (
+	udpUnreliable = 1
+	udpReliable   = 2
+	udpAck        = 3
+	udpPing       = 4
+	udpClose      = 5
+	udpHello      = 6 // {cookie}, the cookie is zero at first
+	udpCookie     = 7 // {cookie}
+	udpAccept     = 8
+
+	udpHeadSize       = 6
+	udpCookieSize     = 16
+	udpCookieLifetime = 30 // seconds, a cookie is valid in two lifetimes
+)
+
+// The settings of UDP sessions.
+type UDPConfig struct {
+	MaxPayloadSize     int
+	WindowSize         int
+	RecvQueueSize      int
+	RetransmitInterval time.Duration
+	MaxRetransmit      int
+	IdleTimeout        time.Duration
+	HandshakeTimeout   time.Duration // Only used by client.
+	MaxSessions        int           // Only used by server, the new peers are refused when reached. Zero means no limit.
+	MaxBufferedPackets int           // The out of order packets are not acknowledged when reached, the peer retransmits them.
+}
+
+// Get the settings from the Default... variables.
+func DefaultUDPConfig() UDPConfig {
+	return UDPConfig{
+		MaxPayloadSize:     DefaultUDPMaxPayloadSize,
+		WindowSize:         DefaultUDPWindowSize,
+		RecvQueueSize:      DefaultUDPRecvQueueSize,
+		RetransmitInterval: DefaultUDPRetransmitInterval,
+		MaxRetransmit:      DefaultUDPMaxRetransmit,
+		IdleTimeout:        DefaultUDPIdleTimeout,
+		HandshakeTimeout:   DefaultUDPHandshakeTimeout,
+		MaxSessions:        DefaultUDPMaxSessions,
+		MaxBufferedPackets: DefaultUDPMaxBufferedPackets,
+	}
+}
+
+// The UDP server. Peers are demultiplexed into sessions by address.
+// Use DatagramProtocol to create channels for UDP sessions.
+//
+// A session is created only after the peer echoed a cookie of its address,
+// so the peers with spoofed addresses can't make the server allocate sessions.
+type UDPServer struct {
+	conn        net.PacketConn
+	secret      []byte
+	broadcaster *Broadcaster
+
+	mutex        sync.RWMutex
+	sessions     map[string]*UDPSession
+	maxSessionId uint64
+
+	stopFlag int32
+	stopChan chan int
+
+	// The settings of sessions, change it before Serve.
+	Config UDPConfig
+
+	DecoderErrorPolicy DecoderErrorPolicy // How the sessions handle decoder errors.
+	middlewares        []DecoderMiddleware
+	middlewareMutex    sync.RWMutex
+
+	State interface{} // server state.
+}
+
+// The easy way to setup a UDP server.
+func ListenUDP(network, address string) (*UDPServer, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewUDPServer(conn), nil
+}
+
+// Create a UDP server.
+func NewUDPServer(conn net.PacketConn) *UDPServer {
+	secret := make([]byte, sha256.Size)
+	rand.Read(secret)
+	server := &UDPServer{
+		conn:     conn,
+		secret:   secret,
+		sessions: make(map[string]*UDPSession),
+		stopChan: make(chan int),
+		Config:   DefaultUDPConfig(),
+
+		DecoderErrorPolicy: DefaultDecoderErrorPolicy,
+	}
+	protocolState, _ := DatagramProtocol.New(server, SERVER_SIDE)
+	server.broadcaster = NewBroadcaster(protocolState, server.fetchSession)
+	return server
+}
+
+// Get server address.
+func (server *UDPServer) Addr() net.Addr {
+	return server.conn.LocalAddr()
+}
+
+// How mush sessions in this server.
+func (server *UDPServer) GetSessionCount() int {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	return len(server.sessions)
+}
+
+// Broadcast to all sessions with reliable channel 0.
+func (server *UDPServer) Broadcast(message Message, timeout time.Duration) ([]BroadcastWork, error) {
+	return server.broadcaster.Broadcast(message, timeout)
+}
+
+// Append decoder middlewares for the new sessions.
+// The middlewares wrap the decoder passed to UDPSession.Process, the first one is the outermost.
+func (server *UDPServer) Use(middlewares ...DecoderMiddleware) {
+	server.middlewareMutex.Lock()
+	defer server.middlewareMutex.Unlock()
+
+	server.middlewares = append(server.middlewares, middlewares...)
+}
+
+// Loop and receive datagrams. The callback will called asynchronously when each session start.
+func (server *UDPServer) Serve(handler func(SessionAble)) error {
+	go server.tickLoop()
+
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := server.conn.ReadFrom(buffer)
+		if err != nil {
+			server.Stop()
+			return err
+		}
+		if n < udpHeadSize {
+			continue
+		}
+		session, isNew := server.getSession(addr, buffer[:n])
+		if session == nil {
+			continue
+		}
+		if isNew {
+			go handler(session)
+			continue
+		}
+		session.handlePacket(buffer[:n])
+	}
+}
+
+// Stop server.
+func (server *UDPServer) Stop() bool {
+	if atomic.CompareAndSwapInt32(&server.stopFlag, 0, 1) {
+		close(server.stopChan)
+		for _, session := range server.copySessions() {
+			session.Close()
+		}
+		server.conn.Close()
+		return true
+	}
+	return false
+}
+
+// Get the session of a packet. A new session is created by a hello packet with valid cookie,
+// the hello packets are handled here and nil is returned for them.
+func (server *UDPServer) getSession(addr net.Addr, packet []byte) (*UDPSession, bool) {
+	key := addr.String()
+
+	server.mutex.RLock()
+	session, exists := server.sessions[key]
+	server.mutex.RUnlock()
+	if exists {
+		if packet[0] == udpHello {
+			// the accept lost
+			session.write(udpPacket(udpAccept, 0, 0, nil))
+			return nil, false
+		}
+		return session, false
+	}
+
+	// the control packets of closed sessions are dropped, and the hello packets must be
+	// padded to the cookie size, so the cookie replies are not larger than the requests
+	if packet[0] != udpHello || len(packet) < udpHeadSize+udpCookieSize {
+		return nil, false
+	}
+	if atomic.LoadInt32(&server.stopFlag) != 0 {
+		return nil, false
+	}
+	if !server.checkCookie(addr, packet[udpHeadSize:udpHeadSize+udpCookieSize]) {
+		server.conn.WriteTo(udpPacket(udpCookie, 0, 0, server.cookie(addr, time.Now().Unix()/udpCookieLifetime)), addr)
+		return nil, false
+	}
+
+	server.mutex.Lock()
+	if session, exists := server.sessions[key]; exists {
+		server.mutex.Unlock()
+		session.write(udpPacket(udpAccept, 0, 0, nil))
+		return nil, false
+	}
+	if server.Config.MaxSessions > 0 && len(server.sessions) >= server.Config.MaxSessions {
+		server.mutex.Unlock()
+		server.conn.WriteTo(udpPacket(udpClose, 0, 0, nil), addr)
+		return nil, false
+	}
+	session = newUDPSession(atomic.AddUint64(&server.maxSessionId, 1), server.conn, addr, server.Config, false)
+	server.middlewareMutex.RLock()
+	session.Use(server.middlewares...)
+	server.middlewareMutex.RUnlock()
+	session.SetDecoderErrorPolicy(server.DecoderErrorPolicy)
+	session.onClose = func() {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+
+		if server.sessions[key] == session {
+			delete(server.sessions, key)
+		}
+	}
+	server.sessions[key] = session
+	server.mutex.Unlock()
+
+	session.write(udpPacket(udpAccept, 0, 0, nil))
+	return session, true
+}
+
+// The cookie of an address in a lifetime.
+func (server *UDPServer) cookie(addr net.Addr, epoch int64) []byte {
+	var buffer [8]byte
+	binary.LittleEndian.PutUint64(buffer[:], uint64(epoch))
+	mac := hmac.New(sha256.New, server.secret)
+	mac.Write(buffer[:])
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:udpCookieSize]
+}
+
+// The cookies of current and last lifetime are valid.
+func (server *UDPServer) checkCookie(addr net.Addr, cookie []byte) bool {
+	epoch := time.Now().Unix() / udpCookieLifetime
+	return hmac.Equal(cookie, server.cookie(addr, epoch)) || hmac.Equal(cookie, server.cookie(addr, epoch-1))
+}
+
+func (server *UDPServer) copySessions() []*UDPSession {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	sessions := make([]*UDPSession, 0, len(server.sessions))
+	for _, session := range server.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (server *UDPServer) fetchSession(callback func(SessionAble)) {
+	for _, session := range server.copySessions() {
+		callback(session)
+	}
+}
+
+// One ticker for all sessions, retransmit and check timeout.
+func (server *UDPServer) tickLoop() {
+	ticker := time.NewTicker(server.Config.RetransmitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, session := range server.copySessions() {
+				session.tick(now)
+			}
+		case <-server.stopChan:
+			return
+		}
+	}
+}
+
+// The UDP session. Messages can be sent reliable with ordering per channel, or unreliable.
+// Send() uses the reliable channel 0, so it works like other sessions.
+type UDPSession struct {
+	id      uint64
+	conn    net.PacketConn
+	addr    net.Addr
+	config  UDPConfig
+	ownConn bool
+	onClose func()
+
+	// About send and receive
+	mutex          sync.Mutex
+	sendChannels   map[uint8]*udpSendChannel
+	recvChannels   map[uint8]*udpRecvChannel
+	bufferedCount  int
+	recvChan       chan []byte
+	readMutex      sync.Mutex
+	createTime     time.Time
+	lastSendTime   time.Time
+	lastRecvTime   time.Time
+	closedByRemote bool
+
+	decoderChain       decoderChain
+	decoderErrorPolicy DecoderErrorPolicy
+
+	// About session close
+	closeChan      chan int
+	closeFlag      int32
+	closeCallbacks closeCallbackList
+
+	// Put your session state here.
+	State interface{}
+}
+
+type udpSendChannel struct {
+	nextSeq uint32
+	pending map[uint32]*udpPending
+}
+
+type udpPending struct {
+	packet  []byte
+	sentAt  time.Time
+	retries int
+}
+
+type udpRecvChannel struct {
+	expected uint32
+	buffered map[uint32][]byte
+}
+
+// The easy way to create a UDP client session.
+func DialUDP(network, address string) (*UDPSession, error) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewUDPSession(conn, addr, DefaultUDPConfig())
+}
+
+// Create a UDP client session on a packet connection. It blocks until the server accepted.
+// The connection will closed when the session closed or the handshake failed.
+func NewUDPSession(conn net.PacketConn, addr net.Addr, config UDPConfig) (*UDPSession, error) {
+	session := newUDPSession(atomic.AddUint64(&dialSessionId, 1), conn, addr, config, true)
+	if err := session.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go session.readLoop()
+	go session.tickLoop()
+	return session, nil
+}
+
+func newUDPSession(id uint64, conn net.PacketConn, addr net.Addr, config UDPConfig, ownConn bool) *UDPSession {
+	now := time.Now()
+	return &UDPSession{
+		id:           id,
+		conn:         conn,
+		addr:         addr,
+		config:       config,
+		ownConn:      ownConn,
+		sendChannels: make(map[uint8]*udpSendChannel),
+		recvChannels: make(map[uint8]*udpRecvChannel),
+		recvChan:     make(chan []byte, config.RecvQueueSize),
+		createTime:   now,
+		lastSendTime: now,
+		lastRecvTime: now,
+		closeChan:    make(chan int),
+
+		decoderErrorPolicy: DefaultDecoderErrorPolicy,
+	}
+}
+
+// Get session id.
+func (session *UDPSession) Id() uint64 {
+	return session.id
+}
+
+// Get the remote address.
+func (session *UDPSession) RemoteAddr() net.Addr {
+	return session.addr
+}
+
+// Get a connection adapter. Read returns one received message, Write sends one unreliable message.
+func (session *UDPSession) Conn() net.Conn {
+	return udpSessionConn{session}
+}
+
+// Check session is closed or not.
+func (session *UDPSession) IsClosed() bool {
+	return atomic.LoadInt32(&session.closeFlag) != 0
+}
+
+// Close session. The remote peer will be notified.
+func (session *UDPSession) Close() {
+	if atomic.CompareAndSwapInt32(&session.closeFlag, 0, 1) {
+		session.mutex.Lock()
+		notify := !session.closedByRemote
+		session.mutex.Unlock()
+
+		if notify {
+			session.write(session.controlPacket(udpClose, 0, 0))
+		}
+		close(session.closeChan)
+		if session.onClose != nil {
+			session.onClose()
+		}
+		if session.ownConn {
+			session.conn.Close()
+		}
+		session.closeCallbacks.invoke()
+	}
+}
+
+// Add close callback.
+func (session *UDPSession) AddCloseCallback(callback func()) CloseCallbackHandle {
+	return session.closeCallbacks.add(callback)
+}
+
+// Remove close callback.
+func (session *UDPSession) RemoveCloseCallback(handle CloseCallbackHandle) {
+	session.closeCallbacks.remove(handle)
+}
+
+func (session *UDPSession) SendDefault(message Message) error {
+	return session.Send(message, zeroTime)
+}
+
+func (session *UDPSession) SendNow(message Message) error {
+	return session.Send(message, time.Now())
+}
+
+// Send a message with the reliable channel 0. The now argument is not used.
+func (session *UDPSession) Send(message Message, now time.Time) error {
+	return session.SendReliable(0, message)
+}
+
+func (session *UDPSession) SendBytesDefault(data []byte) error {
+	return session.SendBytes(data, zeroTime)
+}
+
+func (session *UDPSession) SendBytesNow(data []byte) error {
+	return session.SendBytes(data, time.Now())
+}
+
+func (session *UDPSession) SendBytes(data []byte, now time.Time) error {
+	return session.Send(Bytes(data), now)
+}
+
+// Send a message with a reliable channel. Messages in the same channel are received in order.
+// Returns UDPSendWindowFullError when too many messages are not acknowledged.
+func (session *UDPSession) SendReliable(channel uint8, message Message) error {
+	packet, err := session.dataPacket(udpReliable, channel, message)
+	if err != nil {
+		return err
+	}
+
+	session.mutex.Lock()
+	sendChannel := session.sendChannel(channel)
+	if len(sendChannel.pending) >= session.config.WindowSize {
+		session.mutex.Unlock()
+		return UDPSendWindowFullError
+	}
+	seq := sendChannel.nextSeq
+	sendChannel.nextSeq++
+	binary.LittleEndian.PutUint32(packet[2:], seq)
+	sendChannel.pending[seq] = &udpPending{packet: packet, sentAt: time.Now()}
+	session.mutex.Unlock()
+
+	return session.write(packet)
+}
+
+// Send a message without acknowledgement and retransmission. It may lost or arrive out of order.
+func (session *UDPSession) SendUnreliable(message Message) error {
+	packet, err := session.dataPacket(udpUnreliable, 0, message)
+	if err != nil {
+		return err
+	}
+	return session.write(packet)
+}
+
+// Send a encoded packet with the reliable channel 0, the work is done when this method returned.
+// The timeout is not used, the sending never blocks and fails with UDPSendWindowFullError instead.
+func (session *UDPSession) AsyncSendBuffer(buffer *OutBuffer, timeout time.Duration) AsyncWork {
+	c := make(chan error, 1)
+	c <- session.SendReliable(0, BytesMessage(buffer.GetData()))
+	return AsyncWork{c}
+}
+
+// Read a message. This is for debug, use Process in product environment.
+func (session *UDPSession) ReadPacket() ([]byte, error) {
+	session.readMutex.Lock()
+	defer session.readMutex.Unlock()
+
+	return session.read()
+}
+
+// Process one message.
+func (session *UDPSession) ProcessOnce(decoder Decoder) error {
+	session.readMutex.Lock()
+	defer session.readMutex.Unlock()
+
+	data, err := session.read()
+	if err != nil {
+		return err
+	}
+	if err := session.decoderChain.wrap(decoder)(&InBuffer{Data: data}); err != nil {
+		return session.decoderErrorPolicy.handle(session, err)
+	}
+	return nil
+}
+
+// Append decoder middlewares. Invoke it before Process.
+func (session *UDPSession) Use(middlewares ...DecoderMiddleware) {
+	session.decoderChain.use(middlewares...)
+}
+
+// Set how to handle the decoder errors.
+func (session *UDPSession) SetDecoderErrorPolicy(policy DecoderErrorPolicy) {
+	session.decoderErrorPolicy = policy
+}
+
+// Process messages until the session closed.
+func (session *UDPSession) Process(decoder Decoder) error {
+	for {
+		if err := session.ProcessOnce(decoder); err != nil {
+			return err
+		}
+	}
+}
+
+func (session *UDPSession) GetState() interface{} {
+	return session.State
+}
+
+func (session *UDPSession) SetState(State interface{}) {
+	session.State = State
+}
+
+func (session *UDPSession) GetCreateTime() time.Time {
+	return session.createTime
+}
+
+func (session *UDPSession) GetLastSendTime() time.Time {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.lastSendTime
+}
+
+func (session *UDPSession) GetLastRecvTime() time.Time {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.lastRecvTime
+}
+
+func (session *UDPSession) read() ([]byte, error) {
+	select {
+	case data := <-session.recvChan:
+		session.drain()
+		return data, nil
+	case <-session.closeChan:
+		return nil, io.EOF
+	}
+}
+
+func (session *UDPSession) dataPacket(packetType, channel uint8, message Message) ([]byte, error) {
+	if session.IsClosed() {
+		return nil, SendToClosedError
+	}
+	size := message.Size()
+	if size > session.config.MaxPayloadSize {
+		return nil, UDPPacketTooLargeError
+	}
+	packet := make([]byte, udpHeadSize+size)
+	packet[0] = packetType
+	packet[1] = channel
+	n, err := message.MarshalTo(packet[udpHeadSize:])
+	if err != nil {
+		return nil, err
+	}
+	return packet[:udpHeadSize+n], nil
+}
+
+func (session *UDPSession) controlPacket(packetType, channel uint8, seq uint32) []byte {
+	return udpPacket(packetType, channel, seq, nil)
+}
+
+func udpPacket(packetType, channel uint8, seq uint32, payload []byte) []byte {
+	packet := make([]byte, udpHeadSize+len(payload))
+	packet[0] = packetType
+	packet[1] = channel
+	binary.LittleEndian.PutUint32(packet[2:], seq)
+	copy(packet[udpHeadSize:], payload)
+	return packet
+}
+
+func (session *UDPSession) write(packet []byte) error {
+	if _, err := session.conn.WriteTo(packet, session.addr); err != nil {
+		return err
+	}
+	session.mutex.Lock()
+	session.lastSendTime = time.Now()
+	session.mutex.Unlock()
+	return nil
+}
+
+// Must hold the mutex.
+func (session *UDPSession) sendChannel(channel uint8) *udpSendChannel {
+	sendChannel, exists := session.sendChannels[channel]
+	if !exists {
+		sendChannel = &udpSendChannel{pending: make(map[uint32]*udpPending)}
+		session.sendChannels[channel] = sendChannel
+	}
+	return sendChannel
+}
+
+// Must hold the mutex.
+func (session *UDPSession) recvChannel(channel uint8) *udpRecvChannel {
+	recvChannel, exists := session.recvChannels[channel]
+	if !exists {
+		recvChannel = &udpRecvChannel{buffered: make(map[uint32][]byte)}
+		session.recvChannels[channel] = recvChannel
+	}
+	return recvChannel
+}
+
+// Handle a received datagram. The packet is only valid in this method.
+func (session *UDPSession) handlePacket(packet []byte) {
+	packetType, channel := packet[0], packet[1]
+	seq := binary.LittleEndian.Uint32(packet[2:])
+	payload := packet[udpHeadSize:]
+
+	session.mutex.Lock()
+	session.lastRecvTime = time.Now()
+	session.mutex.Unlock()
+
+	if (packetType == udpUnreliable || packetType == udpReliable) && len(payload) > session.config.MaxPayloadSize {
+		// a well-behaved peer never sends it, drop without ack
+		return
+	}
+
+	switch packetType {
+	case udpUnreliable:
+		session.deliver(copyBytes(payload))
+	case udpReliable:
+		if session.receiveReliable(channel, seq, payload) {
+			session.write(session.controlPacket(udpAck, channel, seq))
+		}
+	case udpAck:
+		session.mutex.Lock()
+		if sendChannel, exists := session.sendChannels[channel]; exists {
+			delete(sendChannel.pending, seq)
+		}
+		session.mutex.Unlock()
+	case udpClose:
+		session.mutex.Lock()
+		session.closedByRemote = true
+		session.mutex.Unlock()
+		session.Close()
+	}
+}
+
+// Returns true when the packet should be acknowledged.
+// A packet is not acknowledged when it can't be delivered or buffered, the peer will retransmit it.
+func (session *UDPSession) receiveReliable(channel uint8, seq uint32, payload []byte) bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	recvChannel := session.recvChannel(channel)
+	distance := int32(seq - recvChannel.expected)
+	switch {
+	case distance < 0:
+		// duplicated, the ack may lost
+		return true
+	case distance > 0:
+		if _, exists := recvChannel.buffered[seq]; exists {
+			return true
+		}
+		if int(distance) >= session.config.WindowSize || session.bufferedCount >= session.config.MaxBufferedPackets {
+			return false
+		}
+		recvChannel.buffered[seq] = copyBytes(payload)
+		session.bufferedCount++
+		return true
+	}
+
+	if !session.deliver(copyBytes(payload)) {
+		return false
+	}
+	recvChannel.expected++
+	session.drainChannel(recvChannel)
+	return true
+}
+
+// Deliver buffered packets when the receive queue has room. Must hold the mutex.
+func (session *UDPSession) drainChannel(recvChannel *udpRecvChannel) {
+	for {
+		data, exists := recvChannel.buffered[recvChannel.expected]
+		if !exists || !session.deliver(data) {
+			return
+		}
+		delete(recvChannel.buffered, recvChannel.expected)
+		session.bufferedCount--
+		recvChannel.expected++
+	}
+}
+
+func (session *UDPSession) drain() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.bufferedCount == 0 {
+		return
+	}
+	for _, recvChannel := range session.recvChannels {
+		session.drainChannel(recvChannel)
+	}
+}
+
+// Put a message into receive queue. Returns false when the queue is full.
+func (session *UDPSession) deliver(data []byte) bool {
+	select {
+	case session.recvChan <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// Retransmit unacked packets, send keepalive and check timeout.
+func (session *UDPSession) tick(now time.Time) {
+	session.mutex.Lock()
+	if now.Sub(session.lastRecvTime) > session.config.IdleTimeout {
+		session.mutex.Unlock()
+		session.Close()
+		return
+	}
+
+	var resend [][]byte
+	lost := false
+	for _, sendChannel := range session.sendChannels {
+		for _, pending := range sendChannel.pending {
+			if now.Sub(pending.sentAt) < session.config.RetransmitInterval {
+				continue
+			}
+			if pending.retries >= session.config.MaxRetransmit {
+				lost = true
+			}
+			pending.retries++
+			pending.sentAt = now
+			resend = append(resend, pending.packet)
+		}
+	}
+	keepalive := now.Sub(session.lastSendTime) > session.config.IdleTimeout/3
+	session.mutex.Unlock()
+
+	if lost {
+		session.Close()
+		return
+	}
+	for _, packet := range resend {
+		session.write(packet)
+	}
+	if keepalive && len(resend) == 0 {
+		session.write(session.controlPacket(udpPing, 0, 0))
+	}
+}
+
+// Send hello until the server accepted, the cookie replied by server is echoed.
+func (session *UDPSession) handshake() error {
+	defer session.conn.SetReadDeadline(time.Time{})
+
+	hello := udpPacket(udpHello, 0, 0, make([]byte, udpCookieSize))
+	buffer := make([]byte, maxDatagramSize)
+	deadline := time.Now().Add(session.config.HandshakeTimeout)
+retry:
+	for time.Now().Before(deadline) {
+		if err := session.write(hello); err != nil {
+			return err
+		}
+		session.conn.SetReadDeadline(time.Now().Add(session.config.RetransmitInterval))
+		for {
+			n, addr, err := session.conn.ReadFrom(buffer)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					continue retry
+				}
+				return err
+			}
+			if n < udpHeadSize || addr.String() != session.addr.String() {
+				continue
+			}
+			switch buffer[0] {
+			case udpCookie:
+				if n >= udpHeadSize+udpCookieSize {
+					hello = udpPacket(udpHello, 0, 0, buffer[udpHeadSize:udpHeadSize+udpCookieSize])
+					continue retry
+				}
+			case udpAccept:
+				return nil
+			case udpClose:
+				return UDPSessionRefusedError
+			default:
+				// the accept lost and the server is sending
+				session.handlePacket(buffer[:n])
+				return nil
+			}
+		}
+	}
+	return UDPHandshakeTimeoutError
+}
+
+// Receive loop of client session.
+func (session *UDPSession) readLoop() {
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := session.conn.ReadFrom(buffer)
+		if err != nil {
+			session.Close()
+			return
+		}
+		if n < udpHeadSize || addr.String() != session.addr.String() {
+			continue
+		}
+		session.handlePacket(buffer[:n])
+	}
+}
+
+// Ticker of client session.
+func (session *UDPSession) tickLoop() {
+	ticker := time.NewTicker(session.config.RetransmitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			session.tick(now)
+		case <-session.closeChan:
+			return
+		}
+	}
+}
+
+func copyBytes(data []byte) []byte {
+	b := make([]byte, len(data))
+	copy(b, data)
+	return b
+}
+
+// The net.Conn adapter of UDP session.
+type udpSessionConn struct {
+	session *UDPSession
+}
+
+// Read one message. The message will truncated when b is not big enough.
+func (conn udpSessionConn) Read(b []byte) (int, error) {
+	data, err := conn.session.ReadPacket()
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, data), nil
+}
+
+// Send one unreliable message.
+func (conn udpSessionConn) Write(b []byte) (int, error) {
+	if err := conn.session.SendUnreliable(BytesMessage(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn udpSessionConn) Close() error {
+	conn.session.Close()
+	return nil
+}
+
+func (conn udpSessionConn) LocalAddr() net.Addr {
+	return conn.session.conn.LocalAddr()
+}
+
+func (conn udpSessionConn) RemoteAddr() net.Addr {
+	return conn.session.addr
+}
+
+func (conn udpSessionConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn udpSessionConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn udpSessionConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
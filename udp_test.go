@@ -0,0 +1,214 @@
+package link
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Drop every n-th outgoing datagram.
+type lossyPacketConn struct {
+	net.PacketConn
+	n     int64
+	count int64
+}
+
+func (conn *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.AddInt64(&conn.count, 1)%conn.n == 0 {
+		return len(b), nil
+	}
+	return conn.PacketConn.WriteTo(b, addr)
+}
+
+func newUDPEchoServer(t *testing.T, lossy int64) *UDPServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := NewUDPServer(&lossyPacketConn{PacketConn: conn, n: lossy})
+	go server.Serve(func(session SessionAble) {
+		session.Process(func(msg *InBuffer) error {
+			return session.SendNow(Bytes(msg.Data))
+		})
+	})
+	return server
+}
+
+func TestUDPReliableOrdering(t *testing.T) {
+	server := newUDPEchoServer(t, 3)
+	defer server.Stop()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	client, err := NewUDPSession(&lossyPacketConn{PacketConn: conn, n: 4}, server.Addr(), DefaultUDPConfig())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, client.SendReliable(uint8(i%2), String(strconv.Itoa(i))))
+	}
+
+	// the server echo with channel 0, so the replies are in the order it received
+	received := make(map[int]bool)
+	lastOfChannel := []int{-1, -1}
+	for i := 0; i < 200; i++ {
+		data, err := client.ReadPacket()
+		assert.Nil(t, err)
+		n, _ := strconv.Atoi(string(data))
+		assert.True(t, n > lastOfChannel[n%2])
+		lastOfChannel[n%2] = n
+		received[n] = true
+	}
+	assert.Equal(t, 200, len(received))
+	assert.Equal(t, 1, server.GetSessionCount())
+}
+
+func TestUDPUnreliable(t *testing.T) {
+	server, err := ListenUDP("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	received := make(chan string, 10)
+	go server.Serve(func(session SessionAble) {
+		session.Process(func(msg *InBuffer) error {
+			received <- string(msg.Data)
+			return nil
+		})
+	})
+	defer server.Stop()
+
+	client, err := DialUDP("udp", server.Addr().String())
+	assert.Nil(t, err)
+	assert.Nil(t, client.SendUnreliable(String("hello")))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "hello", msg)
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+
+	assert.Equal(t, UDPPacketTooLargeError, client.SendUnreliable(Bytes(make([]byte, DefaultUDPMaxPayloadSize+1))))
+
+	client.Close()
+	waitUntil(t, func() bool {
+		return server.GetSessionCount() == 0
+	})
+}
+
+func TestUDPBroadcast(t *testing.T) {
+	server := newUDPEchoServer(t, 1<<62)
+	defer server.Stop()
+
+	clients := make([]*UDPSession, 3)
+	for i := range clients {
+		client, err := DialUDP("udp", server.Addr().String())
+		assert.Nil(t, err)
+		defer client.Close()
+		client.SendNow(String("hello"))
+		data, err := client.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(data))
+		clients[i] = client
+	}
+
+	channel := NewChannel(DatagramProtocol, SERVER_SIDE)
+	server.fetchSession(func(session SessionAble) {
+		channel.Join(session, nil)
+	})
+	_, err := channel.Broadcast(String("world"), 0)
+	assert.Nil(t, err)
+	for _, client := range clients {
+		data, err := client.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, "world", string(data))
+	}
+}
+
+func TestUDPHandshake(t *testing.T) {
+	server := newUDPEchoServer(t, 1<<62)
+	server.Config.MaxSessions = 1
+	defer server.Stop()
+
+	// the packets without handshake don't create session
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.WriteTo(udpPacket(udpReliable, 0, 0, []byte("hello")), server.Addr())
+	assert.Nil(t, err)
+	_, err = conn.WriteTo(udpPacket(udpHello, 0, 0, make([]byte, udpCookieSize)), server.Addr())
+	assert.Nil(t, err)
+	buffer := make([]byte, maxDatagramSize)
+	n, _, err := conn.ReadFrom(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(udpCookie), buffer[0])
+	assert.Equal(t, udpHeadSize+udpCookieSize, n)
+	assert.Equal(t, 0, server.GetSessionCount())
+
+	client, err := DialUDP("udp", server.Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, 1, server.GetSessionCount())
+
+	config := DefaultUDPConfig()
+	config.HandshakeTimeout = time.Second
+	conn2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	_, err = NewUDPSession(conn2, server.Addr(), config)
+	assert.Equal(t, UDPSessionRefusedError, err)
+	assert.Equal(t, 1, server.GetSessionCount())
+}
+
+func TestUDPReceiveLimits(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	config := DefaultUDPConfig()
+	config.MaxBufferedPackets = 100
+	session := newUDPSession(1, conn, conn.LocalAddr(), config, true)
+	defer session.Close()
+
+	// the oversize payloads are dropped
+	session.handlePacket(udpPacket(udpReliable, 0, 1, make([]byte, config.MaxPayloadSize+1)))
+	session.handlePacket(udpPacket(udpUnreliable, 0, 0, make([]byte, config.MaxPayloadSize+1)))
+	assert.Equal(t, 0, session.bufferedCount)
+	assert.Equal(t, 0, len(session.recvChan))
+
+	// flood the out of order packets on many channels
+	for channel := 0; channel < 64; channel++ {
+		for seq := uint32(1); seq <= 10; seq++ {
+			assert.Equal(t, session.bufferedCount < 100, session.receiveReliable(uint8(channel), seq, []byte("x")))
+		}
+	}
+	assert.Equal(t, 100, session.bufferedCount)
+
+	// the expected packets are still delivered
+	assert.True(t, session.receiveReliable(0, 0, []byte("x")))
+	assert.Equal(t, 11, len(session.recvChan))
+	assert.Equal(t, 90, session.bufferedCount)
+}
+
+func TestUDPServerMiddleware(t *testing.T) {
+	server, err := ListenUDP("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	var timed int32
+	server.Use(TimeDecoder(func(duration time.Duration, err error) {
+		atomic.AddInt32(&timed, 1)
+	}))
+	go server.Serve(func(session SessionAble) {
+		session.Process(func(msg *InBuffer) error {
+			return session.SendNow(Bytes(msg.Data))
+		})
+	})
+
+	client, err := DialUDP("udp", server.Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, client.SendNow(String("hello")))
+		data, err := client.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(data))
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&timed))
+}
@@ -0,0 +1,435 @@
+package link
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors
+var (
+	WebSocketHandshakeError      = errors.New("WebSocket handshake failed")
+	WebSocketFrameError          = errors.New("Bad WebSocket frame")
+	WebSocketListenerClosedError = errors.New("WebSocket listener closed")
+)
+
+const (
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	websocketContinuation = 0x0
+	websocketText         = 0x1
+	websocketBinary       = 0x2
+	websocketClose        = 0x8
+	websocketPing         = 0x9
+	websocketPong         = 0xA
+)
+
+// The WebSocket listener. It is a http.Handler upgrade the requests to WebSocket
+// and a net.Listener returns the WebSocket connections, so it can be used by NewServer or Server.AddListener.
+// Each binary message is mapped to one protocol packet.
+type WebSocketListener struct {
+	addr       net.Addr
+	conns      chan net.Conn
+	closeChan  chan int
+	closeFlag  int32
+	httpServer *http.Server
+
+	// Check the origin of the request, nil means accept all.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// The easy way to setup a WebSocket listener. It serves the path on the address with a http server.
+func ListenWebSocket(network, address, path string) (*WebSocketListener, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	wsListener := NewWebSocketListener(listener.Addr())
+	mux := http.NewServeMux()
+	mux.Handle(path, wsListener)
+	wsListener.httpServer = &http.Server{Handler: mux}
+	go wsListener.httpServer.Serve(listener)
+	return wsListener, nil
+}
+
+// Create a WebSocket listener. Mount it on your own http server, the addr is used for Addr().
+func NewWebSocketListener(addr net.Addr) *WebSocketListener {
+	return &WebSocketListener{
+		addr:      addr,
+		conns:     make(chan net.Conn, 128),
+		closeChan: make(chan int),
+	}
+}
+
+// Implement net.Listener interface.
+func (listener *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.closeChan:
+		return nil, WebSocketListenerClosedError
+	}
+}
+
+// Implement net.Listener interface.
+func (listener *WebSocketListener) Close() error {
+	if atomic.CompareAndSwapInt32(&listener.closeFlag, 0, 1) {
+		close(listener.closeChan)
+		if listener.httpServer != nil {
+			listener.httpServer.Close()
+		}
+		for {
+			select {
+			case conn := <-listener.conns:
+				conn.Close()
+			default:
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Implement net.Listener interface.
+func (listener *WebSocketListener) Addr() net.Addr {
+	return listener.addr
+}
+
+// Implement http.Handler interface.
+func (listener *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "Bad WebSocket request", http.StatusBadRequest)
+		return
+	}
+	if listener.CheckOrigin != nil && !listener.CheckOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	wsConn := newWebSocketConn(conn, rw.Reader, false)
+	select {
+	case listener.conns <- wsConn:
+	case <-listener.closeChan:
+		wsConn.Close()
+	}
+}
+
+// The easy way to connect a WebSocket server. The url scheme must be ws or wss.
+func DialWebSocket(rawurl string) (*Session, error) {
+	conn, err := DialWebSocketConn(rawurl, 0)
+	if err != nil {
+		return nil, err
+	}
+	id := atomic.AddUint64(&dialSessionId, 1)
+	return NewSession(id, conn, DefaultProtocol, CLIENT_SIDE, DefaultSendChanSize, DefaultConnBufferSize)
+}
+
+// Connect a WebSocket server and returns the connection. Zero timeout means no timeout.
+func DialWebSocketConn(rawurl string, timeout time.Duration) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", host)
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, WebSocketHandshakeError
+	}
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	keyBytes := make([]byte, 16)
+	rand.Read(keyBytes)
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		conn.Close()
+		return nil, WebSocketHandshakeError
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	return newWebSocketConn(conn, reader, true), nil
+}
+
+func websocketAccept(key string) string {
+	hash := sha1.New()
+	hash.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
+
+func headerContains(header http.Header, name, value string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The WebSocket connection. Write sends one binary message each time,
+// Read reads the payload of data messages as a stream.
+type websocketConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	isClient bool
+
+	// About read
+	remain  uint64
+	mask    [4]byte
+	masked  bool
+	maskPos int
+	closed  bool
+
+	// About write
+	writeMutex sync.Mutex
+	closeFlag  int32
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, isClient bool) *websocketConn {
+	return &websocketConn{
+		Conn:     conn,
+		reader:   reader,
+		isClient: isClient,
+	}
+}
+
+// Implement net.Conn interface.
+func (conn *websocketConn) Read(b []byte) (int, error) {
+	for conn.remain == 0 {
+		if conn.closed {
+			return 0, io.EOF
+		}
+		if err := conn.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > conn.remain {
+		b = b[:conn.remain]
+	}
+	n, err := conn.reader.Read(b)
+	if conn.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= conn.mask[conn.maskPos&3]
+			conn.maskPos++
+		}
+	}
+	conn.remain -= uint64(n)
+	return n, err
+}
+
+// Read the next data frame header, handle the control frames.
+func (conn *websocketConn) nextFrame() error {
+	for {
+		opcode, size, err := conn.readHead()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case websocketContinuation, websocketText, websocketBinary:
+			conn.remain = size
+			return nil
+		case websocketClose, websocketPing, websocketPong:
+			if size > 125 {
+				return WebSocketFrameError
+			}
+			payload := make([]byte, size)
+			if _, err := io.ReadFull(conn.reader, payload); err != nil {
+				return err
+			}
+			if conn.masked {
+				for i := range payload {
+					payload[i] ^= conn.mask[i&3]
+				}
+			}
+			switch opcode {
+			case websocketClose:
+				conn.closed = true
+				conn.writeFrame(websocketClose, payload)
+				return io.EOF
+			case websocketPing:
+				if err := conn.writeFrame(websocketPong, payload); err != nil {
+					return err
+				}
+			}
+		default:
+			return WebSocketFrameError
+		}
+	}
+}
+
+func (conn *websocketConn) readHead() (opcode byte, size uint64, err error) {
+	var head [8]byte
+	if _, err = io.ReadFull(conn.reader, head[:2]); err != nil {
+		return
+	}
+	opcode = head[0] & 0x0F
+	conn.masked = head[1]&0x80 != 0
+	size = uint64(head[1] & 0x7F)
+
+	// client frames must be masked and server frames must not
+	if conn.masked == conn.isClient {
+		err = WebSocketFrameError
+		return
+	}
+
+	switch size {
+	case 126:
+		if _, err = io.ReadFull(conn.reader, head[:2]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(head[:2]))
+	case 127:
+		if _, err = io.ReadFull(conn.reader, head[:8]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(head[:8])
+	}
+
+	if conn.masked {
+		if _, err = io.ReadFull(conn.reader, conn.mask[:]); err != nil {
+			return
+		}
+		conn.maskPos = 0
+	}
+	return
+}
+
+// Implement net.Conn interface. Each write sends one binary message.
+func (conn *websocketConn) Write(b []byte) (int, error) {
+	if err := conn.writeFrame(websocketBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	size := len(payload)
+	frame := make([]byte, 14+size)
+	frame[0] = 0x80 | opcode
+	n := 2
+	switch {
+	case size < 126:
+		frame[1] = byte(size)
+	case size <= 0xFFFF:
+		frame[1] = 126
+		binary.BigEndian.PutUint16(frame[2:], uint16(size))
+		n += 2
+	default:
+		frame[1] = 127
+		binary.BigEndian.PutUint64(frame[2:], uint64(size))
+		n += 8
+	}
+
+	if conn.isClient {
+		frame[1] |= 0x80
+		mask := frame[n : n+4]
+		rand.Read(mask)
+		n += 4
+		for i := 0; i < size; i++ {
+			frame[n+i] = payload[i] ^ mask[i&3]
+		}
+	} else {
+		copy(frame[n:], payload)
+	}
+	n += size
+
+	_, err := conn.Conn.Write(frame[:n])
+	return err
+}
+
+// Implement net.Conn interface. A close frame will send before close the connection.
+func (conn *websocketConn) Close() error {
+	if atomic.CompareAndSwapInt32(&conn.closeFlag, 0, 1) {
+		conn.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.writeFrame(websocketClose, nil)
+		return conn.Conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package link
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketEcho(t *testing.T) {
+	listener, err := ListenWebSocket("tcp", "127.0.0.1:0", "/ws")
+	assert.Nil(t, err)
+	server := NewServer(listener, DefaultProtocol)
+	go server.Serve(func(session SessionAble) {
+		session.Process(func(msg *InBuffer) error {
+			return session.SendNow(Bytes(msg.Data))
+		})
+	})
+	defer server.Stop()
+
+	client, err := DialWebSocket("ws://" + listener.Addr().String() + "/ws")
+	assert.Nil(t, err)
+	defer client.Close()
+
+	for _, size := range []int{1, 10, 125, 126, 1000, 70000} {
+		message := bytes.Repeat([]byte{'a'}, size)
+		assert.Nil(t, client.SendNow(Bytes(message)))
+		data, err := client.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, message, data)
+	}
+}
+
+func TestWebSocketWithTCPListener(t *testing.T) {
+	server, err := Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	wsListener := NewWebSocketListener(server.Listener().Addr())
+	httpServer := httptest.NewServer(wsListener)
+	defer httpServer.Close()
+	assert.Nil(t, server.AddListener(wsListener))
+
+	go server.Serve(func(session SessionAble) {
+		session.Process(func(*InBuffer) error { return nil })
+	})
+	defer server.Stop()
+
+	tcpClient, err := Dial("tcp", server.Listener().Addr().String())
+	assert.Nil(t, err)
+	defer tcpClient.Close()
+	wsClient, err := DialWebSocket(strings.Replace(httpServer.URL, "http", "ws", 1))
+	assert.Nil(t, err)
+	defer wsClient.Close()
+
+	waitUntil(t, func() bool {
+		return server.GetSessionCount() == 2
+	})
+	_, err = server.Broadcast(String("hello"), time.Second)
+	assert.Nil(t, err)
+	for _, client := range []*Session{tcpClient, wsClient} {
+		data, err := client.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(data))
+	}
+}
+
+func TestWebSocketBadRequest(t *testing.T) {
+	listener := NewWebSocketListener(nil)
+	httpServer := httptest.NewServer(listener)
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	_, err = DialWebSocketConn("ws://"+strings.TrimPrefix(httpServer.URL, "http://")+"/", time.Second)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,177 @@
+package link
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Errors
+var (
+	WorkerPoolClosedError = errors.New("Worker pool closed")
+	WorkerQueueFullError  = errors.New("Worker queue full")
+)
+
+// What to do when the queue of a session is full.
+type OverflowPolicy int
+
+const (
+	BlockOnOverflow OverflowPolicy = iota // Block the session reading until the queue has room.
+	DropOnOverflow                        // Drop the message.
+	CloseOnOverflow                       // Close the session.
+)
+
+var (
+	DefaultWorkerQueueSize = 128 // Default max pending messages of each session.
+)
+
+// The worker pool handle messages out of the session reading goroutine.
+// A slow handler don't stall the reading, and the total handler concurrency is bounded.
+// The messages of one session are queued and handled in order, one at a time.
+type WorkerPool struct {
+	queueSize int
+	policy    OverflowPolicy
+
+	mutex    sync.Mutex
+	ready    []*workerQueue // queues have messages and waiting for a worker
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	closed   bool
+	pending  int
+	dropped  uint64
+	wait     sync.WaitGroup
+
+	ErrorPolicy DecoderErrorPolicy // How to handle the handler errors.
+}
+
+type workerQueue struct {
+	session   SessionAble
+	handler   Handler
+	messages  []*InBuffer
+	scheduled bool // in ready list or handled by a worker
+}
+
+// Create a worker pool and start the workers.
+func NewWorkerPool(workers, queueSize int, policy OverflowPolicy) *WorkerPool {
+	pool := &WorkerPool{
+		queueSize:   queueSize,
+		policy:      policy,
+		ErrorPolicy: DefaultDecoderErrorPolicy,
+	}
+	pool.notEmpty = sync.NewCond(&pool.mutex)
+	pool.notFull = sync.NewCond(&pool.mutex)
+	pool.wait.Add(workers)
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+// Create a decoder of the session. The decoder copy the message into a buffer from the global
+// buffer pool and queue it, the handler will be invoked by a worker. The buffer is put back to
+// the pool when the handler returned, so the handler must not keep the message data.
+// Usage: session.Process(pool.Decode(session, router.Dispatch)).
+func (pool *WorkerPool) Decode(session SessionAble, handler Handler) Decoder {
+	queue := &workerQueue{session: session, handler: handler}
+	return func(msg *InBuffer) error {
+		return pool.push(queue, msg)
+	}
+}
+
+// How mush messages waiting for handle.
+func (pool *WorkerPool) Pending() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.pending
+}
+
+// How mush messages dropped by DropOnOverflow policy.
+func (pool *WorkerPool) Dropped() uint64 {
+	return atomic.LoadUint64(&pool.dropped)
+}
+
+// Stop accepting messages, wait the workers handle the pending messages and exit.
+func (pool *WorkerPool) Close() {
+	pool.mutex.Lock()
+	pool.closed = true
+	pool.notEmpty.Broadcast()
+	pool.notFull.Broadcast()
+	pool.mutex.Unlock()
+
+	pool.wait.Wait()
+}
+
+func (pool *WorkerPool) push(queue *workerQueue, msg *InBuffer) error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for !pool.closed && len(queue.messages) >= pool.queueSize {
+		switch pool.policy {
+		case DropOnOverflow:
+			atomic.AddUint64(&pool.dropped, 1)
+			return nil
+		case CloseOnOverflow:
+			queue.session.Close()
+			return WorkerQueueFullError
+		}
+		pool.notFull.Wait()
+	}
+	if pool.closed {
+		return WorkerPoolClosedError
+	}
+
+	// the data is taken from the global buffer pool, and put back by reset after handled
+	buffer := &InBuffer{}
+	buffer.Prepare(len(msg.Data))
+	copy(buffer.Data, msg.Data)
+	buffer.ReadPos = msg.ReadPos
+
+	queue.messages = append(queue.messages, buffer)
+	pool.pending++
+	if !queue.scheduled {
+		queue.scheduled = true
+		pool.ready = append(pool.ready, queue)
+		pool.notEmpty.Signal()
+	}
+	return nil
+}
+
+func (pool *WorkerPool) work() {
+	defer pool.wait.Done()
+
+	for {
+		pool.mutex.Lock()
+		for len(pool.ready) == 0 && !pool.closed {
+			pool.notEmpty.Wait()
+		}
+		if len(pool.ready) == 0 {
+			pool.mutex.Unlock()
+			return
+		}
+		queue := pool.ready[0]
+		pool.ready[0] = nil
+		pool.ready = pool.ready[1:]
+		msg := queue.messages[0]
+		queue.messages[0] = nil
+		queue.messages = queue.messages[1:]
+		pool.pending--
+		pool.notFull.Broadcast()
+		pool.mutex.Unlock()
+
+		if err := queue.handler(queue.session, msg); err != nil {
+			pool.ErrorPolicy.handle(queue.session, err)
+		}
+		msg.reset() // put the data back to the pool
+
+		// the queue stay scheduled while handling, so the messages of a session are in order
+		pool.mutex.Lock()
+		if len(queue.messages) > 0 {
+			pool.ready = append(pool.ready, queue)
+			pool.notEmpty.Signal()
+		} else {
+			queue.scheduled = false
+		}
+		pool.mutex.Unlock()
+	}
+}
@@ -0,0 +1,102 @@
+package link
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolOrdering(t *testing.T) {
+	pool := NewWorkerPool(4, 16, BlockOnOverflow)
+
+	var running, maxRunning int32
+	var mutex sync.Mutex
+	received := make(map[uint64][]uint32)
+	handler := func(session SessionAble, msg *InBuffer) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Duration(msg.Data[3]%3) * 100 * time.Microsecond)
+		mutex.Lock()
+		received[session.Id()] = append(received[session.Id()], msg.ReadUint32LE())
+		mutex.Unlock()
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for id := uint64(1); id <= 10; id++ {
+		session, client := newPipeSessions(t, id)
+		defer client.Close()
+		decode := pool.Decode(session, handler)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := uint32(0); i < 200; i++ {
+				msg := &InBuffer{Data: make([]byte, 4)}
+				binary.LittleEndian.PutUint32(msg.Data, i)
+				assert.Nil(t, decode(msg))
+			}
+		}()
+	}
+	wg.Wait()
+	pool.Close()
+
+	assert.Equal(t, 0, pool.Pending())
+	assert.True(t, atomic.LoadInt32(&maxRunning) <= 4)
+	assert.Equal(t, 10, len(received))
+	for _, messages := range received {
+		assert.Equal(t, 200, len(messages))
+		for i, n := range messages {
+			assert.Equal(t, uint32(i), n)
+		}
+	}
+	assert.Equal(t, WorkerPoolClosedError, pool.Decode(nil, handler)(&InBuffer{}))
+}
+
+func TestWorkerPoolOverflow(t *testing.T) {
+	blocking := make(chan int)
+	handler := func(SessionAble, *InBuffer) error {
+		<-blocking
+		return nil
+	}
+
+	pool := NewWorkerPool(1, 2, DropOnOverflow)
+	session, client := newPipeSessions(t, 1)
+	defer client.Close()
+	decode := pool.Decode(session, handler)
+	// the first message is handling, the queue holds two of the rest
+	assert.Nil(t, decode(&InBuffer{}))
+	waitUntil(t, func() bool {
+		return pool.Pending() == 0
+	})
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, decode(&InBuffer{}))
+	}
+	assert.Equal(t, 2, pool.Pending())
+	assert.Equal(t, uint64(2), pool.Dropped())
+	close(blocking)
+	pool.Close()
+
+	blocking = make(chan int)
+	pool = NewWorkerPool(1, 1, CloseOnOverflow)
+	decode = pool.Decode(session, handler)
+	assert.Nil(t, decode(&InBuffer{}))
+	waitUntil(t, func() bool {
+		return pool.Pending() == 0
+	})
+	assert.Nil(t, decode(&InBuffer{}))
+	assert.Equal(t, WorkerQueueFullError, decode(&InBuffer{}))
+	assert.True(t, session.IsClosed())
+	close(blocking)
+	pool.Close()
+}